@@ -52,3 +52,12 @@ func (a *adapterMock) RawPublish(ctx context.Context, in *gate.RawPublishRequest
 	args := a.Called(ctx, in, opts)
 	return args.Get(0).(*gate.CodeResponse), args.Error(1)
 }
+
+type retainerMock struct {
+	mock.Mock
+}
+
+func (r *retainerMock) Retain(ctx context.Context, top string, qos uint32, pay []byte) error {
+	args := r.Called(ctx, top, qos, pay)
+	return args.Error(0)
+}
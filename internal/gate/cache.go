@@ -0,0 +1,79 @@
+package gate
+
+import (
+	"sync"
+	"time"
+
+	"github.com/blabtm/emqx-gate/vcas"
+)
+
+// cache keeps the last value seen on every topic. A nil cache is valid and
+// never holds anything.
+type cache struct {
+	mux sync.RWMutex
+	dat map[string]entry
+	age time.Duration
+}
+
+type entry struct {
+	pkt vcas.Packet
+	at  time.Time
+}
+
+func newCache(age time.Duration) *cache {
+	return &cache{
+		dat: make(map[string]entry),
+		age: age,
+	}
+}
+
+func (c *cache) store(pkt *vcas.Packet, at time.Time) {
+	if c == nil {
+		return
+	}
+
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	e := entry{pkt: *pkt, at: at}
+	e.pkt.User, e.pkt.Pass, e.pkt.ID = "", "", ""
+
+	c.dat[pkt.Topic] = e
+}
+
+// load returns the value last seen on top unless it is older than the
+// configured age at now.
+func (c *cache) load(top string, now time.Time) (vcas.Packet, bool) {
+	if c == nil {
+		return vcas.Packet{}, false
+	}
+
+	c.mux.RLock()
+	defer c.mux.RUnlock()
+
+	e, ok := c.dat[top]
+
+	if !ok || (c.age > 0 && now.Sub(e.at) > c.age) {
+		return vcas.Packet{}, false
+	}
+
+	return e.pkt, true
+}
+
+// each calls fn with every value not older than the configured age at now.
+func (c *cache) each(now time.Time, fn func(pkt *vcas.Packet)) {
+	if c == nil {
+		return
+	}
+
+	c.mux.RLock()
+	defer c.mux.RUnlock()
+
+	for _, e := range c.dat {
+		if c.age > 0 && now.Sub(e.at) > c.age {
+			continue
+		}
+
+		fn(&e.pkt)
+	}
+}
@@ -0,0 +1,65 @@
+package gate
+
+import (
+	"testing"
+	"time"
+
+	"github.com/blabtm/emqx-gate/vcas"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCache(t *testing.T) {
+	cases := map[string]struct {
+		age time.Duration
+		top string
+		now time.Time
+		exp bool
+	}{
+		`hit`: {
+			top: "test",
+			now: now().Add(time.Hour),
+			exp: true,
+		},
+		`miss`: {
+			top: "other",
+			now: now(),
+		},
+		`fresh`: {
+			age: time.Minute,
+			top: "test",
+			now: now().Add(time.Second),
+			exp: true,
+		},
+		`stale`: {
+			age: time.Minute,
+			top: "test",
+			now: now().Add(time.Hour),
+		},
+	}
+
+	for n, c := range cases {
+		t.Run(n, func(t *testing.T) {
+			lvc := newCache(c.age)
+			pkt := vcas.Packet{
+				Topic: "test",
+				Stamp: vcas.Time{Time: time.UnixMilli(1000)},
+				Value: "11.06",
+				User:  "operator",
+			}
+
+			lvc.store(&pkt, now())
+			res, ok := lvc.load(c.top, c.now)
+
+			assert.Equal(t, c.exp, ok)
+
+			if c.exp {
+				assert.Equal(t, vcas.Packet{
+					Topic: "test",
+					Stamp: vcas.Time{Time: time.UnixMilli(1000)},
+					Value: "11.06",
+				}, res)
+			}
+		})
+	}
+}
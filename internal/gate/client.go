@@ -1,235 +1,1121 @@
 package gate
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"sync"
+	"io"
+	"log/slog"
+	"maps"
+	"slices"
 	"time"
 
 	"github.com/blabtm/emqx-gate/api"
 	"github.com/blabtm/emqx-gate/vcas"
 )
 
+const (
+	getTimeout  = 5 * time.Second
+	sendBatch   = 64 << 10
+	sendTimeout = 5 * time.Second
+	callTimeout = 5 * time.Second
+)
+
+var (
+	errDenied    = errors.New("access denied")
+	errAuth      = errors.New("not authenticated")
+	errMethod    = errors.New("unknown method")
+	errTopic     = errors.New("unknown topic")
+	errValue     = errors.New("malformed value")
+	errFilter    = errors.New("malformed filter")
+	errDuplicate = errors.New("duplicate request")
+	errOverflow  = errors.New("send queue overflow")
+	errClosed    = errors.New("client closed")
+	errShutdown  = errors.New("gateway shutting down")
+)
+
+// resultError is a failed ConnectionAdapter call.
+type resultError struct {
+	code api.ResultCode
+	msg  string
+}
+
+func (e *resultError) Error() string {
+	return fmt.Sprintf("%v: %v", e.code, e.msg)
+}
+
+// resultCode classifies err for the error reply sent to the client.
+func resultCode(err error) api.ResultCode {
+	var res *resultError
+
+	switch {
+	case errors.As(err, &res):
+		return res.code
+	case errors.Is(err, errDenied), errors.Is(err, errAuth):
+		return api.ResultCode_PERMISSION_DENY
+	case errors.Is(err, errTopic):
+		return api.ResultCode_REQUIRED_PARAMS_MISSED
+	case errors.Is(err, errMethod), errors.Is(err, errValue), errors.Is(err, errFilter), errors.Is(err, errDuplicate):
+		return api.ResultCode_PARAMS_TYPE_ERROR
+	default:
+		return api.ResultCode_UNKNOWN
+	}
+}
+
+// client serves a single vcas connection. Everything but the outbound queue
+// is owned by the event loop of the client: socket events, replies from EMQX
+// and timers are posted to its inbox and handled one at a time in order.
 type client struct {
 	conn string
-	obs  string
-	buf  []byte
+	auth bool
+	subs map[string]struct{}
+
+	// dirty is set when subs changed since the session was last saved.
+	dirty bool
+
+	// kept holds the filters of the restored session that EMQX refused to
+	// subscribe to again. They stay in the session until the client
+	// subscribes to them or releases them.
+	kept map[string]struct{}
+
+	// gets holds the timers of the pending get requests by topic, each
+	// request is answered on its own.
+	gets map[string][]*time.Timer
+
+	// waits holds the channels of idle calls waiting for gets to empty.
+	waits []chan struct{}
+
+	tmr  *time.Timer
+	buf  *bytes.Buffer
+	dec  *vcas.Decoder
 	pkt  vcas.Packet
-	mux  sync.Mutex
 	now  func() time.Time
 	cli  api.ConnectionAdapterClient
+	cfg  *Config
+	lvc  *cache
+	ret  retainer
+	port uint32
+	fmts []format
+	tfm  *vcas.Format
+	mpr  *mapper
+	ses  store
+	id   string
+	out  *outbox
+
+	inbox chan event
+	quit  <-chan struct{}
+	stop  context.CancelFunc
+}
+
+// event is a unit of work for the event loop. Posted events run with the
+// context of the loop, called ones with the context of the caller waiting
+// on done.
+type event struct {
+	ctx  context.Context
+	run  func(ctx context.Context) error
+	done chan error
 }
 
-func newClient(conn string, cli api.ConnectionAdapterClient) *client {
-	return &client{
+func newClient(conn string, svc *service) *client {
+	buf := &bytes.Buffer{}
+
+	cli := &client{
 		conn: conn,
-		buf:  make([]byte, 0, 0xff),
+		subs: make(map[string]struct{}),
+		kept: make(map[string]struct{}),
+		gets: make(map[string][]*time.Timer),
+		buf:  buf,
+		dec:  vcas.NewDecoder(buf),
 		now:  time.Now,
-		cli:  cli,
+		cli:  svc.cli,
+		cfg:  svc.cfg,
+		lvc:  svc.lvc,
+		ret:  svc.ret,
+		fmts: svc.fmts,
+		mpr:  svc.mpr,
+		ses:  svc.ses,
 	}
+
+	ctx, stop := context.WithCancel(context.Background())
+
+	cli.inbox = make(chan event, max(svc.cfg.Vcas.Loop.Inbox, 0))
+	cli.quit = ctx.Done()
+	cli.stop = stop
+
+	go cli.loop(ctx)
+
+	if n := svc.cfg.Vcas.Send.Queue; n > 0 {
+		cli.out = newOutbox(n, svc.cfg.Vcas.Send.Overflow)
+
+		go cli.drain(ctx)
+	}
+
+	return cli
 }
 
-func (cli *client) OnReceivedBytes(ctx context.Context, msg []byte) error {
-	cli.mux.Lock()
-	defer cli.mux.Unlock()
+// loop runs the events of the client until ctx is done.
+func (cli *client) loop(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case ev := <-cli.inbox:
+			if ev.done != nil {
+				ev.done <- ev.run(ev.ctx)
+			} else if err := ev.run(ctx); err != nil {
+				slog.Error("loop", "con", cli.conn, "err", err)
+			}
+		}
 
-	for _, b := range msg {
-		if b != 10 {
-			cli.buf = append(cli.buf, b)
-			continue
+		cli.settle()
+	}
+}
+
+// post queues fn for the event loop without waiting for it to run. It blocks
+// while the inbox is full, holding the caller back until the client catches
+// up.
+func (cli *client) post(ctx context.Context, fn func(ctx context.Context) error) error {
+	return cli.enqueue(ctx, event{run: fn})
+}
+
+// call runs fn on the event loop and waits for its result.
+func (cli *client) call(ctx context.Context, fn func(ctx context.Context) error) error {
+	ev := event{ctx: ctx, run: fn, done: make(chan error, 1)}
+
+	if err := cli.enqueue(ctx, ev); err != nil {
+		return err
+	}
+
+	select {
+	case err := <-ev.done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-cli.quit:
+		return errClosed
+	}
+}
+
+func (cli *client) enqueue(ctx context.Context, ev event) error {
+	select {
+	case <-cli.quit:
+		return errClosed
+	default:
+	}
+
+	select {
+	case cli.inbox <- ev:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-cli.quit:
+		return errClosed
+	}
+}
+
+// bound limits a single EMQX call made on behalf of the client.
+func (cli *client) bound(ctx context.Context) (context.Context, context.CancelFunc) {
+	dur := cli.cfg.Vcas.Loop.Timeout
+
+	if dur <= 0 {
+		dur = callTimeout
+	}
+
+	return context.WithTimeout(ctx, dur)
+}
+
+// disconnect asks EMQX to close the socket of the client.
+func (cli *client) disconnect(ctx context.Context) {
+	ctx, cancel := cli.bound(ctx)
+	defer cancel()
+
+	_, _ = cli.cli.Close(ctx, &api.CloseSocketRequest{Conn: cli.conn})
+}
+
+// format picks the timestamp format once the client id is known.
+func (cli *client) format(id string) {
+	cli.tfm = pickFormat(cli.fmts, cli.port, id)
+	cli.dec.SetFormat(cli.tfm)
+}
+
+func (cli *client) authenticate(ctx context.Context, info *api.ClientInfo, pass string) error {
+	info.ProtoName = vcas.Name
+	info.ProtoVer = vcas.Version
+
+	actx, cancel := cli.bound(ctx)
+	defer cancel()
+
+	res, err := cli.cli.Authenticate(actx, &api.AuthenticateRequest{
+		Conn:       cli.conn,
+		Clientinfo: info,
+		Password:   pass,
+	})
+
+	if err != nil {
+		return fmt.Errorf("cli: %w", err)
+	}
+
+	if res.Code != api.ResultCode_SUCCESS {
+		return fmt.Errorf("%w: %v", errDenied, res.Message)
+	}
+
+	cli.auth = true
+	cli.format(info.Clientid)
+
+	slog.Info("authn", "con", cli.conn, "id", info.Clientid, "user", info.Username)
+
+	if cli.ses != nil && info.Clientid != cli.conn {
+		cli.id = info.Clientid
+
+		if err := cli.restore(ctx); err != nil {
+			slog.Error("session", "con", cli.conn, "id", cli.id, "err", err)
 		}
+	}
+
+	if cli.cfg.Vcas.Keepalive > 0 {
+		tctx, cancel := cli.bound(ctx)
+		defer cancel()
 
-		cli.pkt.Stamp.Time = cli.now()
+		res, err := cli.cli.StartTimer(tctx, &api.TimerRequest{
+			Conn:     cli.conn,
+			Type:     api.TimerType_KEEPALIVE,
+			Interval: uint32(cli.cfg.Vcas.Keepalive),
+		})
 
-		if err := cli.pkt.Unmarshal(cli.buf); err != nil {
-			return fmt.Errorf("vcas: %w", err)
+		if err != nil {
+			slog.Error("timer", "con", cli.conn, "err", err)
+		} else if res.Code != api.ResultCode_SUCCESS {
+			slog.Error("timer", "con", cli.conn, "code", res.Code, "msg", res.Message)
 		}
+	}
 
-		if err := cli.handlePacket(ctx, &cli.pkt); err != nil {
-			return err
+	return nil
+}
+
+// await closes the socket unless the client logs in within d.
+func (cli *client) await(d time.Duration) {
+	if d <= 0 {
+		return
+	}
+
+	cli.tmr = time.AfterFunc(d, func() {
+		_ = cli.post(context.Background(), func(ctx context.Context) error {
+			if cli.auth {
+				return nil
+			}
+
+			slog.Info("authn", "con", cli.conn, "err", "timeout")
+			cli.disconnect(ctx)
+
+			return nil
+		})
+	})
+}
+
+func (cli *client) login(ctx context.Context, pkt *vcas.Packet) error {
+	if cli.auth {
+		return fmt.Errorf("already authenticated")
+	}
+
+	id := pkt.Topic
+
+	if id == "" {
+		id = cli.conn
+	}
+
+	err := cli.authenticate(ctx, &api.ClientInfo{
+		Clientid: id,
+		Username: pkt.User,
+	}, pkt.Pass)
+
+	if err != nil {
+		return err
+	}
+
+	if cli.tmr != nil {
+		cli.tmr.Stop()
+	}
+
+	return nil
+}
+
+// close tears the client down once its socket is closed and stops its event
+// loop. Events posted before are handled first.
+func (cli *client) close(ctx context.Context) {
+	cli.end(ctx, true)
+}
+
+// abandon is like close but leaves the subscriptions to EMQX, which drops
+// them with the socket anyway. It is used on shutdown, where releasing them
+// one by one would only hold up the exit.
+func (cli *client) abandon(ctx context.Context) {
+	cli.end(ctx, false)
+}
+
+func (cli *client) end(ctx context.Context, release bool) {
+	err := cli.call(ctx, func(ctx context.Context) error {
+		cli.teardown(ctx, release)
+		return nil
+	})
+
+	if err != nil {
+		slog.Debug("close", "con", cli.conn, "err", err)
+	}
+
+	cli.stop()
+
+	if cli.out != nil {
+		cli.out.reset()
+	}
+}
+
+// idle waits until the client has no pending get requests.
+func (cli *client) idle(ctx context.Context) error {
+	var ch chan struct{}
+
+	err := cli.call(ctx, func(context.Context) error {
+		if len(cli.gets) > 0 {
+			ch = make(chan struct{})
+			cli.waits = append(cli.waits, ch)
 		}
 
-		if cap(cli.buf) > 0xff {
-			cli.buf = make([]byte, 0, 0xff)
-		} else {
-			cli.buf = cli.buf[:0]
+		return nil
+	})
+
+	if err != nil || ch == nil {
+		return err
+	}
+
+	select {
+	case <-ch:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-cli.quit:
+		return errClosed
+	}
+}
+
+// settle wakes the idle callers once the event that answered the last get
+// request is through.
+func (cli *client) settle() {
+	if len(cli.gets) > 0 {
+		return
+	}
+
+	for _, ch := range cli.waits {
+		close(ch)
+	}
+
+	cli.waits = nil
+}
+
+// finish lets the client wind down before the gateway stops: pending get
+// requests are answered, the client is told about the shutdown if notify is
+// set, and queued lines are sent.
+func (cli *client) finish(ctx context.Context, notify bool) error {
+	if err := cli.idle(ctx); err != nil {
+		return fmt.Errorf("get: %w", err)
+	}
+
+	if notify {
+		err := cli.call(ctx, func(ctx context.Context) error {
+			return cli.reply(ctx, &vcas.Packet{}, api.ResultCode_CONN_PROCESS_NOT_ALIVE, errShutdown)
+		})
+
+		if err != nil {
+			return fmt.Errorf("notify: %w", err)
+		}
+	}
+
+	if cli.out != nil {
+		if err := cli.out.flush(ctx); err != nil {
+			return fmt.Errorf("flush: %w", err)
 		}
 	}
 
 	return nil
 }
 
+// teardown cancels pending requests, releases subscriptions unless told
+// otherwise and drops buffered input. The session is saved before either.
+func (cli *client) teardown(ctx context.Context, release bool) {
+	if cli.tmr != nil {
+		cli.tmr.Stop()
+	}
+
+	cli.save()
+
+	for top, tmrs := range cli.gets {
+		for _, tmr := range tmrs {
+			tmr.Stop()
+		}
+
+		delete(cli.gets, top)
+
+		if _, ok := cli.subs[top]; !ok {
+			cli.subs[top] = struct{}{}
+		}
+	}
+
+	if !release {
+		clear(cli.subs)
+	}
+
+	for _, flt := range cli.subscriptions() {
+		if err := cli.unsubscribe(ctx, flt); err != nil {
+			slog.Debug("usub", "con", cli.conn, "top", flt, "err", err)
+		}
+
+		delete(cli.subs, flt)
+	}
+
+	cli.buf.Reset()
+	cli.dec.Reset()
+}
+
+// OnReceivedBytes queues msg for the event loop and returns without waiting
+// for it to be handled.
+func (cli *client) OnReceivedBytes(ctx context.Context, msg []byte) error {
+	receivedBytes.observe(float64(len(msg)))
+
+	return cli.post(ctx, func(ctx context.Context) error {
+		if err := cli.receive(ctx, msg); err != nil {
+			slog.Error("bytes", "con", cli.conn, "pay", string(vcas.Redact(msg)), "err", err)
+		}
+
+		return nil
+	})
+}
+
+func (cli *client) receive(ctx context.Context, msg []byte) error {
+	cli.buf.Write(msg)
+
+	var res error
+
+	for {
+		cli.pkt = vcas.Packet{Stamp: vcas.Time{Time: cli.now()}}
+
+		err := cli.dec.Decode(&cli.pkt)
+
+		if errors.Is(err, io.EOF) {
+			if cli.dirty {
+				cli.save()
+			}
+
+			return res
+		}
+
+		if err != nil {
+			parseErrors.inc()
+
+			err = fmt.Errorf("vcas: %w", err)
+			res = errors.Join(res, err, cli.reply(ctx, &cli.pkt, api.ResultCode_PARAMS_TYPE_ERROR, err))
+
+			continue
+		}
+
+		packetsIn.inc(cli.pkt.Method.String())
+
+		if err := cli.handlePacket(ctx, &cli.pkt); err != nil {
+			res = errors.Join(res, err, cli.reply(ctx, &cli.pkt, resultCode(err), err))
+
+			if cli.pkt.Method == vcas.LOGIN && !cli.auth {
+				cli.disconnect(ctx)
+				return res
+			}
+
+			continue
+		}
+
+		if cli.acked(&cli.pkt) {
+			cli.pkt.Method = vcas.ACK
+
+			if err := cli.emit(ctx, &cli.pkt); err != nil {
+				res = errors.Join(res, fmt.Errorf("ack: %w", err))
+			}
+		}
+	}
+}
+
 func (cli *client) handlePacket(ctx context.Context, pkt *vcas.Packet) error {
-	if cli.obs != "" {
+	if pkt.Method == vcas.PING {
 		return nil
 	}
 
+	if pkt.Method == vcas.LOGIN {
+		if err := cli.login(ctx, pkt); err != nil {
+			return fmt.Errorf("login: %w", err)
+		}
+
+		return nil
+	}
+
+	if !cli.auth {
+		return errAuth
+	}
+
 	if pkt.Topic == "" {
-		return fmt.Errorf("unknown topic")
+		return errTopic
 	}
 
 	switch cli.pkt.Method {
 	case vcas.PUB:
 		if err := cli.publish(ctx, &cli.pkt); err != nil {
-			return fmt.Errorf("pub: %v", err)
+			return fmt.Errorf("pub: %w", err)
 		}
 	case vcas.SUB:
-		if err := cli.subscribe(ctx, cli.pkt.Topic); err != nil {
-			return fmt.Errorf("sub: %v", err)
+		if err := cli.track(ctx, cli.mpr.topic(cli.pkt.Topic)); err != nil {
+			return fmt.Errorf("sub: %w", err)
 		}
 	case vcas.USB:
-		if err := cli.unsubscribe(ctx, cli.pkt.Topic); err != nil {
-			return fmt.Errorf("usub: %v", err)
+		if err := cli.untrack(ctx, cli.mpr.topic(cli.pkt.Topic)); err != nil {
+			return fmt.Errorf("usub: %w", err)
+		}
+	case vcas.PSUB:
+		flt := cli.mpr.filter(cli.pkt.Topic)
+
+		if !valid(flt) {
+			return fmt.Errorf("psub: %w: %v", errFilter, flt)
+		}
+
+		if err := cli.track(ctx, flt); err != nil {
+			return fmt.Errorf("psub: %w", err)
+		}
+	case vcas.PUSB:
+		if err := cli.untrack(ctx, cli.mpr.filter(cli.pkt.Topic)); err != nil {
+			return fmt.Errorf("pusb: %w", err)
 		}
 	case vcas.GET:
 		if err := cli.get(ctx, cli.pkt.Topic); err != nil {
-			return fmt.Errorf("get: %v", err)
+			return fmt.Errorf("get: %w", err)
 		}
 	default:
-		return fmt.Errorf("unknown method")
+		return errMethod
 	}
 
 	return nil
 }
 
 func (cli *client) publish(ctx context.Context, pkt *vcas.Packet) error {
+	switch cli.cfg.Vcas.Typing {
+	case typingLenient, typingStrict:
+		if err := pkt.Resolve(cli.cfg.Vcas.Typing == typingStrict); err != nil {
+			return fmt.Errorf("%w: %w", errValue, err)
+		}
+	default:
+		pkt.Kind = vcas.String
+	}
+
 	pay, err := json.Marshal(pkt)
 
 	if err != nil {
 		return fmt.Errorf("json: %w", err)
 	}
 
+	top := cli.mpr.topic(pkt.Topic)
+	pol := cli.policy(top)
+
+	if pol.Pub.Retain && cli.ret == nil {
+		return fmt.Errorf("retain: not configured")
+	}
+
+	// The retained copy is published with the key of the gateway, so it
+	// follows a plain publish that EMQX authorizes the client for.
+	if err := cli.forward(ctx, top, pol.Pub.Qos, pay); err != nil {
+		return err
+	}
+
+	if pol.Pub.Retain {
+		ctx, cancel := cli.bound(ctx)
+		defer cancel()
+
+		if err := cli.ret.Retain(ctx, top, pol.Pub.Qos, pay); err != nil {
+			return fmt.Errorf("retain: %w", err)
+		}
+	}
+
+	cli.lvc.store(pkt, cli.now())
+
+	return nil
+}
+
+// forward publishes pay to top through the adapter on behalf of the client.
+func (cli *client) forward(ctx context.Context, top string, qos uint32, pay []byte) error {
+	ctx, cancel := cli.bound(ctx)
+	defer cancel()
+
+	beg := time.Now()
 	res, err := cli.cli.Publish(ctx, &api.PublishRequest{
 		Conn:    cli.conn,
-		Topic:   pkt.Topic,
-		Qos:     0,
+		Topic:   top,
+		Qos:     qos,
 		Payload: pay,
 	})
 
+	observe("publish", beg, res, err)
+
 	if err != nil {
 		return fmt.Errorf("cli: %w", err)
 	}
 
 	if res.Code != api.ResultCode_SUCCESS {
-		return fmt.Errorf("cli: %v", res.Message)
+		return fmt.Errorf("cli: %w", &resultError{code: res.Code, msg: res.Message})
+	}
+
+	return nil
+}
+
+func (cli *client) policy(top string) *Policy {
+	for i := range cli.cfg.Vcas.Policies {
+		if match(cli.cfg.Vcas.Policies[i].Topic, top) {
+			return &cli.cfg.Vcas.Policies[i]
+		}
+	}
+
+	return &defaultPolicy
+}
+
+// track subscribes to the filter flt on behalf of the client. Subscribing to
+// the same filter twice is rejected.
+func (cli *client) track(ctx context.Context, flt string) error {
+	if _, ok := cli.subs[flt]; ok {
+		return fmt.Errorf("%w: already subscribed: %v", errDuplicate, flt)
+	}
+
+	if err := cli.subscribe(ctx, flt); err != nil {
+		return err
+	}
+
+	cli.subs[flt] = struct{}{}
+	delete(cli.kept, flt)
+	cli.dirty = true
+
+	return nil
+}
+
+// untrack releases the filter flt. Releasing a filter the client is not
+// subscribed to is rejected.
+func (cli *client) untrack(ctx context.Context, flt string) error {
+	if _, ok := cli.kept[flt]; ok {
+		delete(cli.kept, flt)
+		cli.dirty = true
+
+		return nil
 	}
 
+	if _, ok := cli.subs[flt]; !ok {
+		return fmt.Errorf("%w: not subscribed: %v", errDuplicate, flt)
+	}
+
+	if err := cli.unsubscribe(ctx, flt); err != nil {
+		return err
+	}
+
+	delete(cli.subs, flt)
+	cli.dirty = true
+
 	return nil
 }
 
+// restore re-subscribes to the filters of the previous session of the client
+// and replays the last value seen on the channels matching them. A filter
+// that fails is kept in the session rather than lost.
+func (cli *client) restore(ctx context.Context) error {
+	ses, err := cli.ses.Load(cli.id, cli.now())
+
+	if err != nil {
+		return fmt.Errorf("load: %w", err)
+	}
+
+	if ses == nil {
+		return nil
+	}
+
+	for _, flt := range ses.Subs {
+		if err := cli.subscribe(ctx, flt); err != nil {
+			slog.Error("session", "con", cli.conn, "id", cli.id, "top", flt, "err", err)
+			cli.kept[flt] = struct{}{}
+
+			continue
+		}
+
+		cli.subs[flt] = struct{}{}
+	}
+
+	slog.Info("session", "con", cli.conn, "id", cli.id, "subs", len(cli.subs), "kept", len(cli.kept))
+
+	var pkts []vcas.Packet
+
+	cli.lvc.each(cli.now(), func(pkt *vcas.Packet) {
+		if cli.covered(cli.mpr.topic(pkt.Topic)) {
+			pkts = append(pkts, *pkt)
+		}
+	})
+
+	for i := range pkts {
+		if err := cli.send(ctx, &pkts[i]); err != nil {
+			return fmt.Errorf("send: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// save remembers the subscriptions of an identified client, along with the
+// kept ones.
+func (cli *client) save() {
+	cli.dirty = false
+
+	if cli.ses == nil || cli.id == "" {
+		return
+	}
+
+	subs := slices.AppendSeq(cli.subscriptions(), maps.Keys(cli.kept))
+	slices.Sort(subs)
+
+	if err := cli.ses.Save(cli.id, &session{Subs: subs, At: cli.now()}); err != nil {
+		slog.Error("session", "con", cli.conn, "id", cli.id, "err", err)
+	}
+}
+
+// Subscriptions returns the filters the client is subscribed to in order,
+// or nil once the client is closed.
+func (cli *client) Subscriptions() []string {
+	var subs []string
+
+	_ = cli.call(context.Background(), func(context.Context) error {
+		subs = cli.subscriptions()
+		return nil
+	})
+
+	return subs
+}
+
+func (cli *client) subscriptions() []string {
+	return slices.Sorted(maps.Keys(cli.subs))
+}
+
+// covered reports whether top matches any filter the client subscribed to.
+func (cli *client) covered(top string) bool {
+	for flt := range cli.subs {
+		if match(flt, top) {
+			return true
+		}
+	}
+
+	return false
+}
+
 func (cli *client) subscribe(ctx context.Context, top string) error {
+	ctx, cancel := cli.bound(ctx)
+	defer cancel()
+
+	beg := time.Now()
 	res, err := cli.cli.Subscribe(ctx, &api.SubscribeRequest{
 		Conn:  cli.conn,
 		Topic: top,
-		Qos:   2,
+		Qos:   cli.policy(top).Sub.Qos,
 	})
 
+	observe("subscribe", beg, res, err)
+
 	if err != nil {
 		return fmt.Errorf("cli: %w", err)
 	}
 
 	if res.Code != api.ResultCode_SUCCESS {
-		return fmt.Errorf("cli: %v", res.Message)
+		return fmt.Errorf("cli: %w", &resultError{code: res.Code, msg: res.Message})
 	}
 
 	return nil
 }
 
 func (cli *client) unsubscribe(ctx context.Context, top string) error {
+	ctx, cancel := cli.bound(ctx)
+	defer cancel()
+
+	beg := time.Now()
 	res, err := cli.cli.Unsubscribe(ctx, &api.UnsubscribeRequest{
 		Conn:  cli.conn,
 		Topic: top,
 	})
 
+	observe("unsubscribe", beg, res, err)
+
 	if err != nil {
 		return fmt.Errorf("cli: %w", err)
 	}
 
 	if res.Code != api.ResultCode_SUCCESS {
-		return fmt.Errorf("cli: %v", res.Message)
+		return fmt.Errorf("cli: %w", &resultError{code: res.Code, msg: res.Message})
 	}
 
 	return nil
 }
 
-func (cli *client) get(ctx context.Context, top string) error {
-	err := cli.subscribe(ctx, top)
+func (cli *client) get(ctx context.Context, name string) error {
+	top := cli.mpr.topic(name)
 
-	if err != nil {
-		return fmt.Errorf("sub: %w", err)
+	// The cache is shared by all clients, so the value is only given away
+	// once EMQX let this one subscribe to the channel.
+	_, pending := cli.gets[top]
+	owned := !pending && !cli.covered(top)
+
+	if owned {
+		if err := cli.subscribe(ctx, top); err != nil {
+			return fmt.Errorf("sub: %w", err)
+		}
+	}
+
+	if pkt, ok := cli.lvc.load(name, cli.now()); ok {
+		if owned {
+			if err := cli.unsubscribe(ctx, top); err != nil {
+				slog.Debug("usub", "con", cli.conn, "top", top, "err", err)
+			}
+		}
+
+		return cli.send(ctx, &pkt)
 	}
 
-	cli.obs = top
+	dur := cli.cfg.Vcas.Get.Timeout
 
-	time.AfterFunc(5*time.Second, func() {
-		cli.mux.Lock()
-		defer cli.mux.Unlock()
+	if dur <= 0 {
+		dur = getTimeout
+	}
 
-		if cli.obs != "" {
-			cli.pkt.Topic = cli.obs
-			cli.pkt.Stamp.Time = cli.now()
-			cli.pkt.Value = ""
+	var tmr *time.Timer
 
-			_ = cli.unsubscribe(context.Background(), cli.obs)
-			_ = cli.send(context.Background(), &cli.pkt)
+	tmr = time.AfterFunc(dur, func() {
+		_ = cli.post(context.Background(), func(ctx context.Context) error {
+			i := slices.Index(cli.gets[top], tmr)
 
-			cli.obs = ""
-		}
+			if i < 0 {
+				return nil
+			}
+
+			getTimeouts.inc()
+			cli.gets[top] = slices.Delete(cli.gets[top], i, i+1)
+
+			if len(cli.gets[top]) == 0 {
+				delete(cli.gets, top)
+
+				if !cli.covered(top) {
+					_ = cli.unsubscribe(ctx, top)
+				}
+			}
+
+			cli.pkt = vcas.Packet{Topic: name, Stamp: vcas.Time{Time: cli.now()}}
+
+			if err := cli.send(ctx, &cli.pkt); err != nil {
+				return fmt.Errorf("get: %w", err)
+			}
+
+			return nil
+		})
 	})
 
+	cli.gets[top] = append(cli.gets[top], tmr)
+
 	return nil
 }
 
+// OnReceivedMessage queues msg for the event loop and returns without
+// waiting for it to be delivered.
 func (cli *client) OnReceivedMessage(ctx context.Context, msg *api.Message) error {
-	cli.mux.Lock()
-	defer cli.mux.Unlock()
+	return cli.post(ctx, func(ctx context.Context) error {
+		if err := cli.deliver(ctx, msg); err != nil {
+			slog.Error("msg", "con", cli.conn, "pay", msg, "err", err)
+		}
 
-	if cli.obs != "" {
-		if cli.obs != msg.Topic {
-			return nil
+		return nil
+	})
+}
+
+func (cli *client) deliver(ctx context.Context, msg *api.Message) error {
+	// Every pending get is answered with its own line, one of which stands
+	// for the update when the channel is subscribed to as well.
+	n := 1
+	tmrs, ok := cli.gets[msg.Topic]
+
+	if ok {
+		for _, tmr := range tmrs {
+			tmr.Stop()
 		}
 
-		cli.obs = ""
+		n = len(tmrs)
+		delete(cli.gets, msg.Topic)
 
-		if err := cli.unsubscribe(ctx, msg.Topic); err != nil {
-			return fmt.Errorf("usub: %w", err)
+		if !cli.covered(msg.Topic) {
+			if err := cli.unsubscribe(ctx, msg.Topic); err != nil {
+				return fmt.Errorf("usub: %w", err)
+			}
 		}
+	} else if !cli.covered(msg.Topic) {
+		slog.Debug("msg", "con", cli.conn, "top", msg.Topic, "err", "not subscribed")
+		return nil
 	}
 
-	cli.pkt.Topic = msg.Topic
-	cli.pkt.Value = ""
+	cli.pkt = vcas.Packet{Topic: cli.mpr.name(msg.Topic)}
 
 	if err := json.Unmarshal(msg.Payload, &cli.pkt); err != nil {
 		return fmt.Errorf("json: %w", err)
 	}
 
-	if err := cli.send(ctx, &cli.pkt); err != nil {
-		return fmt.Errorf("send: %w", err)
+	cli.lvc.store(&cli.pkt, cli.now())
+
+	for range n {
+		if err := cli.send(ctx, &cli.pkt); err != nil {
+			return fmt.Errorf("send: %w", err)
+		}
 	}
 
 	return nil
 }
 
+// acked reports whether the client expects an acknowledgement for pkt.
+func (cli *client) acked(pkt *vcas.Packet) bool {
+	return pkt.Method == vcas.PUB && (cli.cfg.Vcas.Ack || pkt.ID != "")
+}
+
 func (cli *client) send(ctx context.Context, pkt *vcas.Packet) error {
 	pkt.Method = vcas.PUB
-	pay, err := pkt.Marshal(make([]byte, 0))
+
+	return cli.emit(ctx, pkt)
+}
+
+func (cli *client) emit(ctx context.Context, pkt *vcas.Packet) error {
+	pay, err := pkt.MarshalFormat(make([]byte, 0), cli.tfm)
+
+	if err != nil {
+		return fmt.Errorf("vcas: %w", err)
+	}
+
+	top := pkt.Topic
+
+	// Acks are replies, which the outbox never drops or coalesces.
+	if pkt.Method == vcas.ACK {
+		top = ""
+	}
+
+	if err := cli.write(ctx, top, pay); err != nil {
+		return err
+	}
+
+	packetsOut.inc(pkt.Method.String())
+
+	return nil
+}
+
+// reply tells the client that its request pkt failed with err.
+func (cli *client) reply(ctx context.Context, pkt *vcas.Packet, code api.ResultCode, err error) error {
+	rep := vcas.Error{
+		Method:  pkt.Method,
+		Stamp:   vcas.Time{Time: cli.now()},
+		Topic:   pkt.Topic,
+		Code:    code.String(),
+		Message: err.Error(),
+		ID:      pkt.ID,
+		Nack:    cli.acked(pkt),
+	}
+
+	pay, err := rep.MarshalFormat(make([]byte, 0), cli.tfm)
 
 	if err != nil {
 		return fmt.Errorf("vcas: %w", err)
 	}
 
+	if err := cli.write(ctx, "", pay); err != nil {
+		return fmt.Errorf("reply: %w", err)
+	}
+
+	if rep.Nack {
+		packetsOut.inc(vcas.NACK.String())
+	} else {
+		packetsOut.inc(vcas.ERR.String())
+	}
+
+	return nil
+}
+
+// write queues the line pay on channel top, or sends it right away when the
+// queue is disabled.
+func (cli *client) write(ctx context.Context, top string, pay []byte) error {
+	if cli.out == nil {
+		ctx, cancel := context.WithTimeout(ctx, cli.timeout())
+		defer cancel()
+
+		return cli.transmit(ctx, pay)
+	}
+
+	if !cli.out.push(top, pay) {
+		slog.Error("send", "con", cli.conn, "err", errOverflow)
+		cli.disconnect(ctx)
+
+		return errOverflow
+	}
+
+	return nil
+}
+
+// drain sends the queued lines in batches until ctx is done.
+func (cli *client) drain(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-cli.out.wake:
+		}
+
+		for pay := cli.out.pop(cli.batch()); pay != nil; pay = cli.out.pop(cli.batch()) {
+			sctx, cancel := context.WithTimeout(ctx, cli.timeout())
+			err := cli.transmit(sctx, pay)
+			cancel()
+			cli.out.sent()
+
+			if err != nil {
+				sendBatches.inc("error")
+				slog.Error("send", "con", cli.conn, "err", err)
+			} else {
+				sendBatches.inc("success")
+			}
+		}
+	}
+}
+
+func (cli *client) timeout() time.Duration {
+	if cli.cfg.Vcas.Send.Timeout > 0 {
+		return cli.cfg.Vcas.Send.Timeout
+	}
+
+	return sendTimeout
+}
+
+func (cli *client) batch() int {
+	if cli.cfg.Vcas.Send.Batch > 0 {
+		return cli.cfg.Vcas.Send.Batch
+	}
+
+	return sendBatch
+}
+
+func (cli *client) transmit(ctx context.Context, pay []byte) error {
+	beg := time.Now()
 	res, err := cli.cli.Send(ctx, &api.SendBytesRequest{
 		Conn:  cli.conn,
 		Bytes: pay,
 	})
 
+	observe("send", beg, res, err)
+
 	if err != nil {
 		return fmt.Errorf("cli: %w", err)
 	}
 
 	if res.Code != api.ResultCode_SUCCESS {
-		return fmt.Errorf("cli: %v", res.Message)
+		return fmt.Errorf("cli: %w", &resultError{code: res.Code, msg: res.Message})
 	}
 
 	return nil
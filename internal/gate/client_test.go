@@ -3,10 +3,12 @@ package gate
 import (
 	"context"
 	"errors"
+	"io"
 	"testing"
 	"time"
 
 	gate "github.com/blabtm/emqx-gate/api"
+	"github.com/blabtm/emqx-gate/vcas"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
@@ -16,8 +18,23 @@ func now() time.Time {
 	return time.UnixMilli(1118509199999)
 }
 
+// receive hands msg to cli on its event loop and waits for the result.
+func receive(cli *client, msg []byte) error {
+	return cli.call(context.Background(), func(ctx context.Context) error {
+		return cli.receive(ctx, msg)
+	})
+}
+
+// deliver hands msg to cli on its event loop and waits for the result.
+func deliver(cli *client, msg *gate.Message) error {
+	return cli.call(context.Background(), func(ctx context.Context) error {
+		return cli.deliver(ctx, msg)
+	})
+}
+
 func TestOnReceivedBytes(t *testing.T) {
 	cases := map[string]struct {
+		cfg    func(*Config)
 		before func(*client)
 		req    []byte
 		pub    *gate.PublishRequest
@@ -32,7 +49,7 @@ func TestOnReceivedBytes(t *testing.T) {
 				Conn:    "test",
 				Topic:   "test",
 				Qos:     0,
-				Payload: []byte(`{"stamp":1118509199999,"value":"11.06"}`),
+				Payload: []byte(`{"timestamp":1118509199999,"value":"11.06"}`),
 			},
 		},
 		`publish without time`: {
@@ -41,7 +58,28 @@ func TestOnReceivedBytes(t *testing.T) {
 				Conn:    "test",
 				Topic:   "test",
 				Qos:     0,
-				Payload: []byte(`{"stamp":1118509199999,"value":"11.06"}`),
+				Payload: []byte(`{"timestamp":1118509199999,"value":"11.06"}`),
+			},
+		},
+		`publish in chunks`: {
+			req: []byte("name:test|meth"),
+			pub: &gate.PublishRequest{
+				Conn:    "test",
+				Topic:   "test",
+				Qos:     0,
+				Payload: []byte(`{"timestamp":1118509199999,"value":"11.06"}`),
+			},
+			before: func(cli *client) {
+				receive(cli, []byte("od:set|val:11.06\r\n"))
+			},
+		},
+		`publish with attributes`: {
+			req: []byte("name:test|method:set|val:11.06|descr:beam current|type:r|units:mA\n"),
+			pub: &gate.PublishRequest{
+				Conn:    "test",
+				Topic:   "test",
+				Qos:     0,
+				Payload: []byte(`{"timestamp":1118509199999,"value":"11.06","description":"beam current","type":"r","units":"mA"}`),
 			},
 		},
 		`subscribe`: {
@@ -53,12 +91,20 @@ func TestOnReceivedBytes(t *testing.T) {
 			},
 		},
 		`unsubscribe`: {
-			req: []byte("name:test|method:release\n"),
+			req: []byte("name:test|method:subscribe\nname:test|method:release\n"),
+			sub: &gate.SubscribeRequest{
+				Conn:  "test",
+				Topic: "test",
+				Qos:   2,
+			},
 			usub: &gate.UnsubscribeRequest{
 				Conn:  "test",
 				Topic: "test",
 			},
 		},
+		`ping`: {
+			req: []byte("method:ping\n"),
+		},
 		`get with message`: {
 			req: []byte("name:test|method:get\n"),
 			sub: &gate.SubscribeRequest{
@@ -75,10 +121,10 @@ func TestOnReceivedBytes(t *testing.T) {
 				Bytes: []byte("time:11.06.2005 23_59_59.999|method:set|name:test|val:11.06|descr:none|type:rw|units:none\n"),
 			},
 			before: func(cli *client) {
-				cli.OnReceivedMessage(context.Background(), &gate.Message{
+				deliver(cli, &gate.Message{
 					Topic:   "test",
 					Qos:     0,
-					Payload: []byte(`{"stamp":1118509199999,"value":"11.06"}`),
+					Payload: []byte(`{"timestamp":1118509199999,"value":"11.06"}`),
 				})
 			},
 		},
@@ -97,8 +143,11 @@ func TestOnReceivedBytes(t *testing.T) {
 				Conn:  "test",
 				Bytes: []byte("time:11.06.2005 23_59_59.999|method:set|name:test|val:none|descr:none|type:rw|units:none\n"),
 			},
+			cfg: func(cfg *Config) {
+				cfg.Vcas.Get.Timeout = 100 * time.Millisecond
+			},
 			before: func(cli *client) {
-				time.Sleep(6 * time.Second)
+				time.Sleep(200 * time.Millisecond)
 			},
 		},
 	}
@@ -116,10 +165,17 @@ func TestOnReceivedBytes(t *testing.T) {
 			apr.On("Send", mock.Anything, c.send, mock.Anything).
 				Return(&gate.CodeResponse{Code: gate.ResultCode_SUCCESS}, nil)
 
-			cli := newClient("test", apr)
+			cfg := &Config{}
+
+			if c.cfg != nil {
+				c.cfg(cfg)
+			}
+
+			cli := newClient("test", &service{cli: apr, cfg: cfg})
+			cli.auth = true
 			cli.now = now
 
-			err := cli.OnReceivedBytes(context.Background(), c.req)
+			err := receive(cli, c.req)
 
 			if c.err != nil {
 				assert.True(t, errors.Is(err, c.err))
@@ -170,13 +226,80 @@ func TestOnReceivedMessage(t *testing.T) {
 			req: &gate.Message{
 				Topic:   "test",
 				Qos:     0,
-				Payload: []byte(`{"stamp":1118509199999,"value":"11.06"}`),
+				Payload: []byte(`{"timestamp":1118509199999,"value":"11.06"}`),
 			},
 			send: &gate.SendBytesRequest{
 				Conn:  "test",
 				Bytes: []byte("time:11.06.2005 23_59_59.999|method:set|name:test|val:11.06|descr:none|type:rw|units:none\n"),
 			},
 		},
+		`publish with number`: {
+			req: &gate.Message{
+				Topic:   "test",
+				Qos:     0,
+				Payload: []byte(`{"timestamp":1118509199999,"value":11.06}`),
+			},
+			send: &gate.SendBytesRequest{
+				Conn:  "test",
+				Bytes: []byte("time:11.06.2005 23_59_59.999|method:set|name:test|val:11.06|descr:none|type:rw|units:none\n"),
+			},
+		},
+		`publish with attributes`: {
+			req: &gate.Message{
+				Topic:   "test",
+				Qos:     0,
+				Payload: []byte(`{"timestamp":1118509199999,"value":"11.06","description":"beam current","type":"r","units":"mA"}`),
+			},
+			send: &gate.SendBytesRequest{
+				Conn:  "test",
+				Bytes: []byte("time:11.06.2005 23_59_59.999|method:set|name:test|val:11.06|descr:beam current|type:r|units:mA\n"),
+			},
+		},
+		`publish with alarm`: {
+			req: &gate.Message{
+				Topic:   "test",
+				Qos:     0,
+				Payload: []byte(`{"timestamp":1118509199999,"value":11.06,"severity":"MAJOR","status":"HIHI"}`),
+			},
+			send: &gate.SendBytesRequest{
+				Conn:  "test",
+				Bytes: []byte("time:11.06.2005 23_59_59.999|method:set|name:test|val:11.06|descr:none|type:rw|units:none|severity:MAJOR|status:HIHI\n"),
+			},
+		},
+		`publish with wildcard`: {
+			before: func(cli *client) {
+				delete(cli.subs, "test")
+				cli.subs["RING/+/X"] = struct{}{}
+			},
+			req: &gate.Message{
+				Topic:   "RING/BPM/X",
+				Payload: []byte(`{"timestamp":1118509199999,"value":0.5}`),
+			},
+			send: &gate.SendBytesRequest{
+				Conn:  "test",
+				Bytes: []byte("time:11.06.2005 23_59_59.999|method:set|name:RING/BPM/X|val:0.5|descr:none|type:rw|units:none\n"),
+			},
+		},
+		`publish without subscription`: {
+			before: func(cli *client) {
+				delete(cli.subs, "test")
+			},
+			req: &gate.Message{
+				Topic:   "test",
+				Payload: []byte(`{"timestamp":1118509199999,"value":0.5}`),
+			},
+		},
+		`publish with array`: {
+			req: &gate.Message{
+				Topic:   "test",
+				Qos:     0,
+				Payload: []byte(`{"timestamp":1118509199999,"value":[1.5,2,"a,b"]}`),
+			},
+			send: &gate.SendBytesRequest{
+				Conn:  "test",
+				Bytes: []byte("time:11.06.2005 23_59_59.999|method:set|name:test|val:1.5,2,a\\,b|descr:none|type:rw|units:none|kind:array|len:3\n"),
+			},
+		},
 	}
 
 	for n, c := range cases {
@@ -192,19 +315,21 @@ func TestOnReceivedMessage(t *testing.T) {
 			apr.On("Send", mock.Anything, c.send, mock.Anything).
 				Return(&gate.CodeResponse{Code: gate.ResultCode_SUCCESS}, nil)
 
-			cli := newClient("test", apr)
+			cli := newClient("test", &service{cli: apr, cfg: &Config{}})
+			cli.auth = true
 			cli.now = now
+			cli.subs["test"] = struct{}{}
+
+			if c.before != nil {
+				c.before(cli)
+			}
 
-			err := cli.OnReceivedMessage(context.Background(), c.req)
+			err := deliver(cli, c.req)
 
 			if c.err != nil {
 				assert.True(t, errors.Is(err, c.err))
 			}
 
-			if c.before != nil {
-				c.before(cli)
-			}
-
 			if c.pub != nil {
 				apr.AssertCalled(t, "Publish", mock.Anything, c.pub, mock.Anything)
 			} else {
@@ -231,3 +356,832 @@ func TestOnReceivedMessage(t *testing.T) {
 		})
 	}
 }
+
+func TestGet(t *testing.T) {
+	apr := &adapterMock{}
+
+	apr.On("Subscribe", mock.Anything, mock.Anything, mock.Anything).
+		Return(&gate.CodeResponse{Code: gate.ResultCode_SUCCESS}, nil)
+	apr.On("Unsubscribe", mock.Anything, mock.Anything, mock.Anything).
+		Return(&gate.CodeResponse{Code: gate.ResultCode_SUCCESS}, nil)
+	apr.On("Publish", mock.Anything, mock.Anything, mock.Anything).
+		Return(&gate.CodeResponse{Code: gate.ResultCode_SUCCESS}, nil)
+	apr.On("Send", mock.Anything, mock.Anything, mock.Anything).
+		Return(&gate.CodeResponse{Code: gate.ResultCode_SUCCESS}, nil)
+
+	cfg := &Config{}
+	cfg.Vcas.Get.Timeout = 100 * time.Millisecond
+
+	cli := newClient("test", &service{cli: apr, cfg: cfg})
+	cli.auth = true
+	cli.now = now
+
+	timeouts := getTimeouts.get()
+
+	err := receive(cli, []byte(""+
+		"name:a|method:get\n"+
+		"name:b|method:get\n"+
+		"name:a|method:get\n"+
+		"name:b|method:get\n"+
+		"name:c|method:set|val:1\n",
+	))
+
+	assert.Nil(t, err)
+	apr.AssertNumberOfCalls(t, "Subscribe", 2)
+	apr.AssertNumberOfCalls(t, "Publish", 1)
+
+	err = deliver(cli, &gate.Message{
+		Topic:   "b",
+		Payload: []byte(`{"timestamp":1118509199999,"value":"11.06"}`),
+	})
+
+	assert.Nil(t, err)
+	apr.AssertCalled(t, "Unsubscribe", mock.Anything, &gate.UnsubscribeRequest{Conn: "test", Topic: "b"}, mock.Anything)
+	apr.AssertCalled(t, "Send", mock.Anything, &gate.SendBytesRequest{
+		Conn:  "test",
+		Bytes: []byte("time:11.06.2005 23_59_59.999|method:set|name:b|val:11.06|descr:none|type:rw|units:none\n"),
+	}, mock.Anything)
+	apr.AssertNumberOfCalls(t, "Send", 2)
+
+	time.Sleep(200 * time.Millisecond)
+
+	apr.AssertCalled(t, "Unsubscribe", mock.Anything, &gate.UnsubscribeRequest{Conn: "test", Topic: "a"}, mock.Anything)
+	apr.AssertCalled(t, "Send", mock.Anything, &gate.SendBytesRequest{
+		Conn:  "test",
+		Bytes: []byte("time:11.06.2005 23_59_59.999|method:set|name:a|val:none|descr:none|type:rw|units:none\n"),
+	}, mock.Anything)
+	apr.AssertNumberOfCalls(t, "Unsubscribe", 2)
+	apr.AssertNumberOfCalls(t, "Send", 4)
+	assert.Equal(t, uint64(2), getTimeouts.get()-timeouts)
+}
+
+func TestGetCached(t *testing.T) {
+	tests := map[string]struct {
+		code gate.ResultCode
+		sent string
+	}{
+		`allowed`: {
+			code: gate.ResultCode_SUCCESS,
+			sent: "time:01.01.2005 00_00_00.000|method:set|name:test|val:11.06|descr:none|type:rw|units:none\n",
+		},
+		`denied`: {
+			code: gate.ResultCode_PERMISSION_DENY,
+			sent: "time:11.06.2005 23_59_59.999|method:error|req:get|name:test|code:PERMISSION_DENY|msg:get: sub: cli: PERMISSION_DENY: \n",
+		},
+	}
+
+	for n, test := range tests {
+		t.Run(n, func(t *testing.T) {
+			apr := &adapterMock{}
+
+			apr.On("Publish", mock.Anything, mock.Anything, mock.Anything).
+				Return(&gate.CodeResponse{Code: gate.ResultCode_SUCCESS}, nil)
+			apr.On("Subscribe", mock.Anything, mock.Anything, mock.Anything).
+				Return(&gate.CodeResponse{Code: test.code}, nil)
+			apr.On("Unsubscribe", mock.Anything, mock.Anything, mock.Anything).
+				Return(&gate.CodeResponse{Code: gate.ResultCode_SUCCESS}, nil)
+			apr.On("Send", mock.Anything, mock.Anything, mock.Anything).
+				Return(&gate.CodeResponse{Code: gate.ResultCode_SUCCESS}, nil)
+
+			lvc := newCache(0)
+
+			pub := newClient("pub", &service{cli: apr, cfg: &Config{}, lvc: lvc})
+			pub.auth = true
+			pub.now = now
+
+			err := receive(pub, []byte("time:01.01.2005 00_00_00.000|name:test|method:set|val:11.06\n"))
+			assert.Nil(t, err)
+
+			cli := newClient("test", &service{cli: apr, cfg: &Config{}, lvc: lvc})
+			cli.auth = true
+			cli.now = now
+
+			_ = receive(cli, []byte("name:test|method:get\n"))
+
+			apr.AssertCalled(t, "Subscribe", mock.Anything, &gate.SubscribeRequest{Conn: "test", Topic: "test", Qos: 2}, mock.Anything)
+			apr.AssertCalled(t, "Send", mock.Anything, &gate.SendBytesRequest{
+				Conn:  "test",
+				Bytes: []byte(test.sent),
+			}, mock.Anything)
+			apr.AssertNumberOfCalls(t, "Send", 1)
+			assert.Empty(t, cli.gets)
+
+			if test.code == gate.ResultCode_SUCCESS {
+				apr.AssertCalled(t, "Unsubscribe", mock.Anything, &gate.UnsubscribeRequest{Conn: "test", Topic: "test"}, mock.Anything)
+			}
+		})
+	}
+}
+
+func TestPolicy(t *testing.T) {
+	apr := &adapterMock{}
+	ret := &retainerMock{}
+
+	apr.On("Publish", mock.Anything, mock.Anything, mock.Anything).
+		Return(&gate.CodeResponse{Code: gate.ResultCode_SUCCESS}, nil)
+	apr.On("Subscribe", mock.Anything, mock.Anything, mock.Anything).
+		Return(&gate.CodeResponse{Code: gate.ResultCode_SUCCESS}, nil)
+	ret.On("Retain", mock.Anything, mock.Anything, mock.Anything, mock.Anything).
+		Return(nil)
+
+	cfg := &Config{}
+	cfg.Vcas.Policies = make([]Policy, 2)
+	cfg.Vcas.Policies[0].Topic = "set/#"
+	cfg.Vcas.Policies[0].Pub.Qos = 1
+	cfg.Vcas.Policies[0].Pub.Retain = true
+	cfg.Vcas.Policies[1].Topic = "+/fast"
+	cfg.Vcas.Policies[1].Sub.Qos = 0
+
+	cli := newClient("test", &service{cli: apr, cfg: cfg, ret: ret})
+	cli.auth = true
+	cli.now = now
+
+	err := receive(cli, []byte(""+
+		"name:set/a|method:set|val:1\n"+
+		"name:get/a|method:set|val:2\n"+
+		"name:set/fast|method:subscribe\n"+
+		"name:get/fast|method:subscribe\n"+
+		"name:get/slow|method:subscribe\n",
+	))
+
+	assert.Nil(t, err)
+
+	ret.AssertCalled(t, "Retain", mock.Anything, "set/a", uint32(1), []byte(`{"timestamp":1118509199999,"value":"1"}`))
+	ret.AssertNumberOfCalls(t, "Retain", 1)
+	apr.AssertCalled(t, "Publish", mock.Anything, &gate.PublishRequest{
+		Conn:    "test",
+		Topic:   "set/a",
+		Qos:     1,
+		Payload: []byte(`{"timestamp":1118509199999,"value":"1"}`),
+	}, mock.Anything)
+	apr.AssertCalled(t, "Publish", mock.Anything, &gate.PublishRequest{
+		Conn:    "test",
+		Topic:   "get/a",
+		Qos:     0,
+		Payload: []byte(`{"timestamp":1118509199999,"value":"2"}`),
+	}, mock.Anything)
+	apr.AssertNumberOfCalls(t, "Publish", 2)
+	apr.AssertCalled(t, "Subscribe", mock.Anything, &gate.SubscribeRequest{Conn: "test", Topic: "set/fast", Qos: 0}, mock.Anything)
+	apr.AssertCalled(t, "Subscribe", mock.Anything, &gate.SubscribeRequest{Conn: "test", Topic: "get/fast", Qos: 0}, mock.Anything)
+	apr.AssertCalled(t, "Subscribe", mock.Anything, &gate.SubscribeRequest{Conn: "test", Topic: "get/slow", Qos: 2}, mock.Anything)
+}
+
+func TestRetainDenied(t *testing.T) {
+	apr := &adapterMock{}
+	ret := &retainerMock{}
+
+	apr.On("Publish", mock.Anything, mock.Anything, mock.Anything).
+		Return(&gate.CodeResponse{Code: gate.ResultCode_PERMISSION_DENY}, nil)
+	apr.On("Send", mock.Anything, mock.Anything, mock.Anything).
+		Return(&gate.CodeResponse{Code: gate.ResultCode_SUCCESS}, nil)
+
+	cfg := &Config{}
+	cfg.Vcas.Policies = []Policy{{Topic: "#"}}
+	cfg.Vcas.Policies[0].Pub.Retain = true
+
+	cli := newClient("test", &service{cli: apr, cfg: cfg, ret: ret})
+	cli.auth = true
+	cli.now = now
+
+	err := receive(cli, []byte("name:a|method:set|val:1\n"))
+
+	assert.NotNil(t, err)
+	ret.AssertNotCalled(t, "Retain", mock.Anything, mock.Anything, mock.Anything, mock.Anything)
+}
+
+func TestReply(t *testing.T) {
+	cases := map[string]struct {
+		req  []byte
+		code gate.ResultCode
+		send *gate.SendBytesRequest
+	}{
+		`with malformed time`: {
+			req: []byte("time:11.06.2005 23:59:59.999|name:test|method:set|val:11.06\n"),
+			send: &gate.SendBytesRequest{
+				Conn:  "test",
+				Bytes: []byte("time:11.06.2005 23_59_59.999|method:error|req:set|name:test|code:PARAMS_TYPE_ERROR|msg:vcas: time: format: parsing time \"11.06.2005 23:59:59.999\" as \"02.01.2006 15_04_05.000\": cannot parse \":59:59.999\" as \"_\"\n"),
+			},
+		},
+		`with unknown method`: {
+			req: []byte("name:test|method:extra\n"),
+			send: &gate.SendBytesRequest{
+				Conn:  "test",
+				Bytes: []byte("time:11.06.2005 23_59_59.999|method:error|name:test|code:PARAMS_TYPE_ERROR|msg:vcas: method: unknown: extra\n"),
+			},
+		},
+		`without method`: {
+			req: []byte("name:test|val:11.06\n"),
+			send: &gate.SendBytesRequest{
+				Conn:  "test",
+				Bytes: []byte("time:11.06.2005 23_59_59.999|method:error|name:test|code:PARAMS_TYPE_ERROR|msg:unknown method\n"),
+			},
+		},
+		`without name`: {
+			req: []byte("method:set|val:11.06\n"),
+			send: &gate.SendBytesRequest{
+				Conn:  "test",
+				Bytes: []byte("time:11.06.2005 23_59_59.999|method:error|req:set|name:none|code:REQUIRED_PARAMS_MISSED|msg:unknown topic\n"),
+			},
+		},
+		`with denial`: {
+			req:  []byte("name:test|method:set|val:11.06\n"),
+			code: gate.ResultCode_PERMISSION_DENY,
+			send: &gate.SendBytesRequest{
+				Conn:  "test",
+				Bytes: []byte("time:11.06.2005 23_59_59.999|method:error|req:set|name:test|code:PERMISSION_DENY|msg:pub: cli: PERMISSION_DENY: denied\n"),
+			},
+		},
+	}
+
+	for n, c := range cases {
+		t.Run(n, func(t *testing.T) {
+			apr := &adapterMock{}
+
+			apr.On("Publish", mock.Anything, mock.Anything, mock.Anything).
+				Return(&gate.CodeResponse{Code: c.code, Message: "denied"}, nil)
+			apr.On("Send", mock.Anything, mock.Anything, mock.Anything).
+				Return(&gate.CodeResponse{Code: gate.ResultCode_SUCCESS}, nil)
+
+			cli := newClient("test", &service{cli: apr, cfg: &Config{}})
+			cli.auth = true
+			cli.now = now
+
+			err := receive(cli, append(c.req, "name:next|method:set|val:1\n"...))
+
+			assert.NotNil(t, err)
+			apr.AssertCalled(t, "Send", mock.Anything, c.send, mock.Anything)
+			apr.AssertCalled(t, "Publish", mock.Anything, &gate.PublishRequest{
+				Conn:    "test",
+				Topic:   "next",
+				Payload: []byte(`{"timestamp":1118509199999,"value":"1"}`),
+			}, mock.Anything)
+		})
+	}
+}
+
+func TestAck(t *testing.T) {
+	cases := map[string]struct {
+		ack  bool
+		req  []byte
+		code gate.ResultCode
+		send *gate.SendBytesRequest
+	}{
+		`with config`: {
+			ack: true,
+			req: []byte("time:01.01.2005 00_00_00.000|name:test|method:set|val:11.06\n"),
+			send: &gate.SendBytesRequest{
+				Conn:  "test",
+				Bytes: []byte("time:01.01.2005 00_00_00.000|method:ack|name:test|val:11.06|descr:none|type:rw|units:none\n"),
+			},
+		},
+		`with request id`: {
+			req: []byte("name:test|method:set|val:11.06|id:42\n"),
+			send: &gate.SendBytesRequest{
+				Conn:  "test",
+				Bytes: []byte("time:11.06.2005 23_59_59.999|method:ack|name:test|val:11.06|descr:none|type:rw|units:none|id:42\n"),
+			},
+		},
+		`with failure`: {
+			req:  []byte("name:test|method:set|val:11.06|id:42\n"),
+			code: gate.ResultCode_PERMISSION_DENY,
+			send: &gate.SendBytesRequest{
+				Conn:  "test",
+				Bytes: []byte("time:11.06.2005 23_59_59.999|method:nack|req:set|name:test|code:PERMISSION_DENY|msg:pub: cli: PERMISSION_DENY: denied|id:42\n"),
+			},
+		},
+		`without ack`: {
+			req: []byte("name:test|method:set|val:11.06\n"),
+		},
+	}
+
+	for n, c := range cases {
+		t.Run(n, func(t *testing.T) {
+			apr := &adapterMock{}
+
+			apr.On("Publish", mock.Anything, mock.Anything, mock.Anything).
+				Return(&gate.CodeResponse{Code: c.code, Message: "denied"}, nil)
+			apr.On("Send", mock.Anything, mock.Anything, mock.Anything).
+				Return(&gate.CodeResponse{Code: gate.ResultCode_SUCCESS}, nil)
+
+			cfg := &Config{}
+			cfg.Vcas.Ack = c.ack
+
+			cli := newClient("test", &service{cli: apr, cfg: cfg})
+			cli.auth = true
+			cli.now = now
+
+			_ = receive(cli, c.req)
+
+			if c.send != nil {
+				apr.AssertCalled(t, "Send", mock.Anything, c.send, mock.Anything)
+				apr.AssertNumberOfCalls(t, "Send", 1)
+			} else {
+				apr.AssertNotCalled(t, "Send", mock.Anything, mock.Anything, mock.Anything)
+			}
+		})
+	}
+}
+
+func TestTyping(t *testing.T) {
+	cases := map[string]struct {
+		typ string
+		req []byte
+		pay []byte
+		err bool
+	}{
+		`text`: {
+			typ: "text",
+			req: []byte("name:test|method:set|val:11.06\n"),
+			pay: []byte(`{"timestamp":1118509199999,"value":"11.06"}`),
+		},
+		`text with kind`: {
+			typ: "text",
+			req: []byte("name:test|method:set|val:11.06|kind:float\n"),
+			pay: []byte(`{"timestamp":1118509199999,"value":"11.06"}`),
+		},
+		`lenient`: {
+			typ: "lenient",
+			req: []byte("name:test|method:set|val:11.06\n"),
+			pay: []byte(`{"timestamp":1118509199999,"value":11.06}`),
+		},
+		`lenient with mismatch`: {
+			typ: "lenient",
+			req: []byte("name:test|method:set|val:11.06|kind:int\n"),
+			pay: []byte(`{"timestamp":1118509199999,"value":"11.06"}`),
+		},
+		`lenient with array`: {
+			typ: "lenient",
+			req: []byte("name:test|method:set|val:1.5,2,on|kind:array|len:3\n"),
+			pay: []byte(`{"timestamp":1118509199999,"value":[1.5,2,"on"]}`),
+		},
+		`lenient with array mismatch`: {
+			typ: "lenient",
+			req: []byte("name:test|method:set|val:1.5,2|kind:array|len:3\n"),
+			pay: []byte(`{"timestamp":1118509199999,"value":"1.5,2"}`),
+		},
+		`lenient with alarm`: {
+			typ: "lenient",
+			req: []byte("name:test|method:set|val:11.06|severity:minor|status:HIGH\n"),
+			pay: []byte(`{"timestamp":1118509199999,"value":11.06,"severity":"MINOR","status":"HIGH"}`),
+		},
+		`strict`: {
+			typ: "strict",
+			req: []byte("name:test|method:set|val:true\n"),
+			pay: []byte(`{"timestamp":1118509199999,"value":true}`),
+		},
+		`strict with mismatch`: {
+			typ: "strict",
+			req: []byte("name:test|method:set|val:11.06|kind:int\n"),
+			err: true,
+		},
+	}
+
+	for n, c := range cases {
+		t.Run(n, func(t *testing.T) {
+			apr := &adapterMock{}
+
+			apr.On("Publish", mock.Anything, mock.Anything, mock.Anything).
+				Return(&gate.CodeResponse{Code: gate.ResultCode_SUCCESS}, nil)
+			apr.On("Send", mock.Anything, mock.Anything, mock.Anything).
+				Return(&gate.CodeResponse{Code: gate.ResultCode_SUCCESS}, nil)
+
+			cfg := &Config{}
+			cfg.Vcas.Typing = c.typ
+
+			cli := newClient("test", &service{cli: apr, cfg: cfg})
+			cli.auth = true
+			cli.now = now
+
+			err := receive(cli, c.req)
+
+			if c.err {
+				assert.NotNil(t, err)
+				apr.AssertNotCalled(t, "Publish", mock.Anything, mock.Anything, mock.Anything)
+				apr.AssertCalled(t, "Send", mock.Anything, &gate.SendBytesRequest{
+					Conn:  "test",
+					Bytes: []byte("time:11.06.2005 23_59_59.999|method:error|req:set|name:test|code:PARAMS_TYPE_ERROR|msg:pub: malformed value: value: not int: 11.06\n"),
+				}, mock.Anything)
+
+				return
+			}
+
+			assert.Nil(t, err)
+			apr.AssertCalled(t, "Publish", mock.Anything, &gate.PublishRequest{
+				Conn:    "test",
+				Topic:   "test",
+				Payload: c.pay,
+			}, mock.Anything)
+		})
+	}
+}
+
+func TestLogin(t *testing.T) {
+	cases := map[string]struct {
+		req  []byte
+		auth *gate.AuthenticateRequest
+		code gate.ResultCode
+		exp  bool
+	}{
+		`with credentials`: {
+			req: []byte("method:login|name:dev01|user:operator|pass:secret\n"),
+			auth: &gate.AuthenticateRequest{
+				Conn: "test",
+				Clientinfo: &gate.ClientInfo{
+					ProtoName: "VCAS",
+					ProtoVer:  "1.0-SNAPSHOT",
+					Clientid:  "dev01",
+					Username:  "operator",
+				},
+				Password: "secret",
+			},
+			exp: true,
+		},
+		`without name`: {
+			req: []byte("method:login|user:operator\n"),
+			auth: &gate.AuthenticateRequest{
+				Conn: "test",
+				Clientinfo: &gate.ClientInfo{
+					ProtoName: "VCAS",
+					ProtoVer:  "1.0-SNAPSHOT",
+					Clientid:  "test",
+					Username:  "operator",
+				},
+			},
+			exp: true,
+		},
+		`with denial`: {
+			req: []byte("method:login|name:dev01|user:operator|pass:wrong\n"),
+			auth: &gate.AuthenticateRequest{
+				Conn: "test",
+				Clientinfo: &gate.ClientInfo{
+					ProtoName: "VCAS",
+					ProtoVer:  "1.0-SNAPSHOT",
+					Clientid:  "dev01",
+					Username:  "operator",
+				},
+				Password: "wrong",
+			},
+			code: gate.ResultCode_PERMISSION_DENY,
+		},
+		`without login`: {
+			req: []byte("name:test|method:set|val:11.06\n"),
+		},
+	}
+
+	for n, c := range cases {
+		t.Run(n, func(t *testing.T) {
+			apr := &adapterMock{}
+
+			apr.On("Authenticate", mock.Anything, c.auth, mock.Anything).
+				Return(&gate.CodeResponse{Code: c.code}, nil)
+			apr.On("Close", mock.Anything, mock.Anything, mock.Anything).
+				Return(&gate.CodeResponse{Code: gate.ResultCode_SUCCESS}, nil)
+			apr.On("Send", mock.Anything, mock.Anything, mock.Anything).
+				Return(&gate.CodeResponse{Code: gate.ResultCode_SUCCESS}, nil)
+
+			cli := newClient("test", &service{cli: apr, cfg: &Config{}})
+			cli.now = now
+
+			err := receive(cli, c.req)
+
+			assert.Equal(t, c.exp, cli.auth)
+			apr.AssertNotCalled(t, "Publish", mock.Anything, mock.Anything, mock.Anything)
+
+			if c.exp {
+				assert.Nil(t, err)
+				apr.AssertCalled(t, "Authenticate", mock.Anything, c.auth, mock.Anything)
+				apr.AssertNotCalled(t, "Close", mock.Anything, mock.Anything, mock.Anything)
+				apr.AssertNotCalled(t, "Send", mock.Anything, mock.Anything, mock.Anything)
+			} else {
+				assert.NotNil(t, err)
+				apr.AssertNumberOfCalls(t, "Send", 1)
+			}
+
+			if c.code != gate.ResultCode_SUCCESS {
+				apr.AssertCalled(t, "Close", mock.Anything, &gate.CloseSocketRequest{Conn: "test"}, mock.Anything)
+			}
+		})
+	}
+}
+
+func TestLoginTimeout(t *testing.T) {
+	apr := &adapterMock{}
+
+	apr.On("Close", mock.Anything, mock.Anything, mock.Anything).
+		Return(&gate.CodeResponse{Code: gate.ResultCode_SUCCESS}, nil)
+
+	cli := newClient("test", &service{cli: apr, cfg: &Config{}})
+	cli.await(10 * time.Millisecond)
+
+	time.Sleep(50 * time.Millisecond)
+
+	apr.AssertCalled(t, "Close", mock.Anything, &gate.CloseSocketRequest{Conn: "test"}, mock.Anything)
+}
+
+func TestWildcard(t *testing.T) {
+	apr := &adapterMock{}
+
+	apr.On("Subscribe", mock.Anything, mock.Anything, mock.Anything).
+		Return(&gate.CodeResponse{Code: gate.ResultCode_SUCCESS}, nil)
+	apr.On("Unsubscribe", mock.Anything, mock.Anything, mock.Anything).
+		Return(&gate.CodeResponse{Code: gate.ResultCode_SUCCESS}, nil)
+	apr.On("Send", mock.Anything, mock.Anything, mock.Anything).
+		Return(&gate.CodeResponse{Code: gate.ResultCode_SUCCESS}, nil)
+
+	mpr, err := newMapper(&Mapping{Subst: []Subst{{From: ":", To: "/"}}})
+	assert.Nil(t, err)
+
+	cli := newClient("test", &service{cli: apr, cfg: &Config{}, mpr: mpr})
+	cli.auth = true
+	cli.now = now
+
+	err = receive(cli, []byte(""+
+		"name:RING:BPM:+:X|method:psubscribe\n"+
+		"name:RING:BPM:02:X|method:get\n",
+	))
+
+	assert.Nil(t, err)
+	apr.AssertCalled(t, "Subscribe", mock.Anything, &gate.SubscribeRequest{
+		Conn:  "test",
+		Topic: "RING/BPM/+/X",
+		Qos:   2,
+	}, mock.Anything)
+	apr.AssertNumberOfCalls(t, "Subscribe", 1)
+
+	for _, top := range []string{"RING/BPM/01/X", "RING/BPM/02/X", "RING/BPM/02/Y"} {
+		err = deliver(cli, &gate.Message{
+			Topic:   top,
+			Payload: []byte(`{"timestamp":1118509199999,"value":0.5}`),
+		})
+
+		assert.Nil(t, err)
+	}
+
+	apr.AssertCalled(t, "Send", mock.Anything, &gate.SendBytesRequest{
+		Conn:  "test",
+		Bytes: []byte("time:11.06.2005 23_59_59.999|method:set|name:RING:BPM:01:X|val:0.5|descr:none|type:rw|units:none\n"),
+	}, mock.Anything)
+	apr.AssertCalled(t, "Send", mock.Anything, &gate.SendBytesRequest{
+		Conn:  "test",
+		Bytes: []byte("time:11.06.2005 23_59_59.999|method:set|name:RING:BPM:02:X|val:0.5|descr:none|type:rw|units:none\n"),
+	}, mock.Anything)
+	apr.AssertNumberOfCalls(t, "Send", 2)
+	apr.AssertNotCalled(t, "Unsubscribe", mock.Anything, mock.Anything, mock.Anything)
+	assert.Empty(t, cli.gets)
+
+	err = receive(cli, []byte(""+
+		"name:RING:BPM:+:X|method:prelease\n"+
+		"name:RING:BPM+:X|method:psubscribe\n",
+	))
+
+	assert.NotNil(t, err)
+	apr.AssertCalled(t, "Unsubscribe", mock.Anything, &gate.UnsubscribeRequest{
+		Conn:  "test",
+		Topic: "RING/BPM/+/X",
+	}, mock.Anything)
+	apr.AssertCalled(t, "Send", mock.Anything, &gate.SendBytesRequest{
+		Conn:  "test",
+		Bytes: []byte("time:11.06.2005 23_59_59.999|method:error|req:psubscribe|name:RING:BPM+:X|code:PARAMS_TYPE_ERROR|msg:psub: malformed filter: RING/BPM+/X\n"),
+	}, mock.Anything)
+	apr.AssertNumberOfCalls(t, "Subscribe", 1)
+	assert.Empty(t, cli.subs)
+}
+
+func TestSubscriptions(t *testing.T) {
+	apr := &adapterMock{}
+
+	apr.On("Subscribe", mock.Anything, mock.Anything, mock.Anything).
+		Return(&gate.CodeResponse{Code: gate.ResultCode_SUCCESS}, nil)
+	apr.On("Unsubscribe", mock.Anything, mock.Anything, mock.Anything).
+		Return(&gate.CodeResponse{Code: gate.ResultCode_SUCCESS}, nil)
+	apr.On("Send", mock.Anything, mock.Anything, mock.Anything).
+		Return(&gate.CodeResponse{Code: gate.ResultCode_SUCCESS}, nil)
+
+	cli := newClient("test", &service{cli: apr, cfg: &Config{}})
+	cli.auth = true
+	cli.now = now
+
+	err := receive(cli, []byte(""+
+		"name:a|method:subscribe\n"+
+		"name:a|method:subscribe\n"+
+		"name:b/+|method:psubscribe\n"+
+		"name:c|method:release\n"+
+		"name:d|method:get\n"+
+		"name:e|meth",
+	))
+
+	assert.ErrorIs(t, err, errDuplicate)
+	assert.Equal(t, []string{"a", "b/+"}, cli.Subscriptions())
+	apr.AssertCalled(t, "Send", mock.Anything, &gate.SendBytesRequest{
+		Conn:  "test",
+		Bytes: []byte("time:11.06.2005 23_59_59.999|method:error|req:subscribe|name:a|code:PARAMS_TYPE_ERROR|msg:sub: duplicate request: already subscribed: a\n"),
+	}, mock.Anything)
+	apr.AssertCalled(t, "Send", mock.Anything, &gate.SendBytesRequest{
+		Conn:  "test",
+		Bytes: []byte("time:11.06.2005 23_59_59.999|method:error|req:release|name:c|code:PARAMS_TYPE_ERROR|msg:usub: duplicate request: not subscribed: c\n"),
+	}, mock.Anything)
+	apr.AssertNumberOfCalls(t, "Subscribe", 3)
+	apr.AssertNotCalled(t, "Unsubscribe", mock.Anything, mock.Anything, mock.Anything)
+
+	cli.close(context.Background())
+
+	for _, top := range []string{"a", "b/+", "d"} {
+		apr.AssertCalled(t, "Unsubscribe", mock.Anything, &gate.UnsubscribeRequest{Conn: "test", Topic: top}, mock.Anything)
+	}
+
+	apr.AssertNumberOfCalls(t, "Unsubscribe", 3)
+	assert.Empty(t, cli.Subscriptions())
+	assert.Empty(t, cli.gets)
+	assert.Zero(t, cli.buf.Len())
+	assert.ErrorIs(t, cli.dec.Decode(&vcas.Packet{}), io.EOF)
+}
+
+func TestSendQueue(t *testing.T) {
+	apr := &adapterMock{}
+	cfg := &Config{}
+	cfg.Vcas.Send.Queue = 2
+	cfg.Vcas.Send.Overflow = overflowDisconnect
+
+	sent := make(chan struct{}, 1)
+	block := make(chan struct{})
+
+	apr.On("Send", mock.Anything, &gate.SendBytesRequest{Conn: "test", Bytes: []byte("a\n")}, mock.Anything).
+		Run(func(mock.Arguments) { sent <- struct{}{}; <-block }).
+		Return(&gate.CodeResponse{Code: gate.ResultCode_SUCCESS}, nil)
+	apr.On("Send", mock.Anything, &gate.SendBytesRequest{Conn: "test", Bytes: []byte("b\nc\n")}, mock.Anything).
+		Run(func(mock.Arguments) { sent <- struct{}{} }).
+		Return(&gate.CodeResponse{Code: gate.ResultCode_SUCCESS}, nil)
+	apr.On("Close", mock.Anything, mock.Anything, mock.Anything).
+		Return(&gate.CodeResponse{Code: gate.ResultCode_SUCCESS}, nil)
+
+	cli := newClient("test", &service{cli: apr, cfg: cfg})
+	ctx := context.Background()
+
+	defer cli.close(ctx)
+
+	assert.Nil(t, cli.write(ctx, "a", []byte("a\n")))
+
+	<-sent
+
+	assert.Nil(t, cli.write(ctx, "b", []byte("b\n")))
+	assert.Nil(t, cli.write(ctx, "", []byte("c\n")))
+
+	assert.ErrorIs(t, cli.write(ctx, "d", []byte("d\n")), errOverflow)
+	apr.AssertCalled(t, "Close", mock.Anything, &gate.CloseSocketRequest{Conn: "test"}, mock.Anything)
+
+	close(block)
+
+	select {
+	case <-sent:
+	case <-time.After(time.Second):
+		t.Fatal("queued lines were not sent")
+	}
+
+	apr.AssertNumberOfCalls(t, "Send", 2)
+}
+
+func TestSendQueueAck(t *testing.T) {
+	ack := "time:11.06.2005 23_59_59.999|method:ack|name:test|val:1|descr:none|type:rw|units:none\n"
+
+	tests := map[string]struct {
+		pol  string
+		sent string
+	}{
+		`drop-oldest`: {
+			pol:  overflowDropOldest,
+			sent: "z\n" + ack,
+		},
+		`drop-newest`: {
+			pol:  overflowDropNewest,
+			sent: "z\n" + ack,
+		},
+		`latest`: {
+			pol:  overflowLatest,
+			sent: "z\n" + ack,
+		},
+		`disconnect`: {
+			pol:  overflowDisconnect,
+			sent: "y\nz\n",
+		},
+	}
+
+	for n, test := range tests {
+		t.Run(n, func(t *testing.T) {
+			apr := &adapterMock{}
+			cfg := &Config{}
+			cfg.Vcas.Ack = true
+			cfg.Vcas.Send.Queue = 2
+			cfg.Vcas.Send.Overflow = test.pol
+
+			sent := make(chan []byte, 2)
+			block := make(chan struct{})
+
+			apr.On("Publish", mock.Anything, mock.Anything, mock.Anything).
+				Return(&gate.CodeResponse{Code: gate.ResultCode_SUCCESS}, nil)
+			apr.On("Send", mock.Anything, &gate.SendBytesRequest{Conn: "test", Bytes: []byte("x\n")}, mock.Anything).
+				Run(func(mock.Arguments) { sent <- nil; <-block }).
+				Return(&gate.CodeResponse{Code: gate.ResultCode_SUCCESS}, nil)
+			apr.On("Send", mock.Anything, mock.Anything, mock.Anything).
+				Run(func(args mock.Arguments) { sent <- args.Get(1).(*gate.SendBytesRequest).Bytes }).
+				Return(&gate.CodeResponse{Code: gate.ResultCode_SUCCESS}, nil)
+			apr.On("Close", mock.Anything, mock.Anything, mock.Anything).
+				Return(&gate.CodeResponse{Code: gate.ResultCode_SUCCESS}, nil)
+			apr.On("Unsubscribe", mock.Anything, mock.Anything, mock.Anything).
+				Return(&gate.CodeResponse{Code: gate.ResultCode_SUCCESS}, nil)
+
+			cli := newClient("test", &service{cli: apr, cfg: cfg})
+			cli.auth = true
+			cli.now = now
+
+			ctx := context.Background()
+
+			defer cli.close(ctx)
+
+			assert.Nil(t, cli.write(ctx, "test", []byte("x\n")))
+
+			<-sent
+
+			assert.Nil(t, cli.write(ctx, "test", []byte("y\n")))
+			assert.Nil(t, cli.write(ctx, "test", []byte("z\n")))
+
+			err := receive(cli, []byte("name:test|method:set|val:1\n"))
+
+			if test.pol == overflowDisconnect {
+				assert.ErrorIs(t, err, errOverflow)
+				apr.AssertCalled(t, "Close", mock.Anything, &gate.CloseSocketRequest{Conn: "test"}, mock.Anything)
+			} else {
+				assert.Nil(t, err)
+			}
+
+			close(block)
+
+			select {
+			case pay := <-sent:
+				assert.Equal(t, test.sent, string(pay))
+			case <-time.After(time.Second):
+				t.Fatal("queued lines were not sent")
+			}
+		})
+	}
+}
+
+func TestLoop(t *testing.T) {
+	apr := &adapterMock{}
+	cfg := &Config{}
+	cfg.Vcas.Loop.Inbox = 4
+
+	block := make(chan struct{})
+	tops := make(chan string, 4)
+
+	apr.On("Publish", mock.Anything, mock.Anything, mock.Anything).
+		Run(func(args mock.Arguments) {
+			<-block
+			tops <- args.Get(1).(*gate.PublishRequest).Topic
+		}).
+		Return(&gate.CodeResponse{Code: gate.ResultCode_SUCCESS}, nil)
+	apr.On("Unsubscribe", mock.Anything, mock.Anything, mock.Anything).
+		Return(&gate.CodeResponse{Code: gate.ResultCode_SUCCESS}, nil)
+
+	cli := newClient("test", &service{cli: apr, cfg: cfg})
+	cli.auth = true
+	cli.now = now
+
+	ctx := context.Background()
+
+	for _, name := range []string{"a", "b", "c"} {
+		assert.Nil(t, cli.OnReceivedBytes(ctx, []byte("name:"+name+"|method:set|val:1\n")))
+	}
+
+	close(block)
+	cli.close(ctx)
+
+	assert.Equal(t, "a", <-tops)
+	assert.Equal(t, "b", <-tops)
+	assert.Equal(t, "c", <-tops)
+	assert.ErrorIs(t, cli.OnReceivedBytes(ctx, []byte("name:d|method:set|val:1\n")), errClosed)
+	assert.Nil(t, cli.Subscriptions())
+}
+
+func TestLoopTimeout(t *testing.T) {
+	apr := &adapterMock{}
+	cfg := &Config{}
+	cfg.Vcas.Loop.Timeout = 50 * time.Millisecond
+
+	apr.On("Publish", mock.Anything, mock.Anything, mock.Anything).
+		Run(func(args mock.Arguments) { <-args.Get(0).(context.Context).Done() }).
+		Return((*gate.CodeResponse)(nil), context.DeadlineExceeded)
+	apr.On("Send", mock.Anything, mock.Anything, mock.Anything).
+		Return(&gate.CodeResponse{Code: gate.ResultCode_SUCCESS}, nil)
+
+	cli := newClient("test", &service{cli: apr, cfg: cfg})
+	cli.auth = true
+	cli.now = now
+
+	defer cli.close(context.Background())
+
+	err := receive(cli, []byte("name:a|method:set|val:1\nname:b|method:set|val:1\n"))
+
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	apr.AssertNumberOfCalls(t, "Publish", 2)
+	apr.AssertNumberOfCalls(t, "Send", 2)
+}
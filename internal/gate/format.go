@@ -0,0 +1,79 @@
+package gate
+
+import (
+	"fmt"
+	"path"
+	"slices"
+
+	"github.com/blabtm/emqx-gate/vcas"
+)
+
+// TimeRule overrides the timestamp format for the sockets accepted on Port
+// and the clients whose id matches the Clientid pattern, where an unset
+// field matches anything. The first matching rule wins, and unset Layout
+// and Zone are taken from the defaults.
+type TimeRule struct {
+	Port     uint32
+	Clientid string
+	Layout   string
+	Zone     string
+}
+
+type format struct {
+	port     uint32
+	clientid string
+	fmt      *vcas.Format
+}
+
+// newFormats compiles the time rules followed by the default format, which
+// matches every client.
+func newFormats(cfg *Config) ([]format, error) {
+	def := &cfg.Vcas.Time
+	res := make([]format, 0, len(def.Rules)+1)
+
+	for _, rule := range append(slices.Clone(def.Rules), TimeRule{}) {
+		if _, err := path.Match(rule.Clientid, ""); err != nil {
+			return nil, fmt.Errorf("time: %v: %w", rule.Clientid, err)
+		}
+
+		if rule.Layout == "" {
+			rule.Layout = def.Layout
+		}
+
+		if rule.Zone == "" {
+			rule.Zone = def.Zone
+		}
+
+		f, err := vcas.NewFormat(rule.Layout, rule.Zone)
+
+		if err != nil {
+			return nil, fmt.Errorf("time: %w", err)
+		}
+
+		res = append(res, format{port: rule.Port, clientid: rule.Clientid, fmt: f})
+	}
+
+	return res, nil
+}
+
+// pickFormat returns the format for a client with id connected to port. A
+// client id pattern never matches before the client is identified.
+func pickFormat(fmts []format, port uint32, id string) *vcas.Format {
+	for i := range fmts {
+		f := &fmts[i]
+
+		if f.port != 0 && f.port != port {
+			continue
+		}
+
+		if f.clientid != "" {
+			if ok, _ := path.Match(f.clientid, id); !ok || id == "" {
+				continue
+			}
+		}
+
+		return f.fmt
+	}
+
+	return nil
+}
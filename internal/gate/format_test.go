@@ -0,0 +1,86 @@
+package gate
+
+import (
+	"testing"
+
+	gate "github.com/blabtm/emqx-gate/api"
+	"github.com/blabtm/emqx-gate/vcas"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func TestPickFormat(t *testing.T) {
+	cfg := &Config{}
+	cfg.Vcas.Time.Zone = "Europe/Berlin"
+	cfg.Vcas.Time.Rules = []TimeRule{
+		{Port: 7994, Layout: vcas.ISO8601},
+		{Clientid: "spectro-*", Layout: vcas.Epoch, Zone: "UTC"},
+	}
+
+	fmts, err := newFormats(cfg)
+	assert.Nil(t, err)
+
+	cases := map[string]struct {
+		port uint32
+		id   string
+		lay  string
+		zone string
+	}{
+		`default`:         {port: 7993, lay: "", zone: "Europe/Berlin"},
+		`by port`:         {port: 7994, id: "spectro-1", lay: vcas.ISO8601, zone: "Europe/Berlin"},
+		`by client`:       {port: 7993, id: "spectro-1", lay: vcas.Epoch, zone: "UTC"},
+		`by other client`: {port: 7993, id: "ccd-1", lay: "", zone: "Europe/Berlin"},
+	}
+
+	for n, c := range cases {
+		t.Run(n, func(t *testing.T) {
+			f := pickFormat(fmts, c.port, c.id)
+
+			assert.Equal(t, c.lay, f.Layout)
+			assert.Equal(t, c.zone, f.Zone.String())
+		})
+	}
+
+	cfg.Vcas.Time.Rules = []TimeRule{{Clientid: "["}}
+	_, err = newFormats(cfg)
+	assert.NotNil(t, err)
+
+	cfg.Vcas.Time.Rules = []TimeRule{{Zone: "Mars/Olympus"}}
+	_, err = newFormats(cfg)
+	assert.NotNil(t, err)
+}
+
+func TestTimeFormat(t *testing.T) {
+	apr := &adapterMock{}
+
+	apr.On("Publish", mock.Anything, mock.Anything, mock.Anything).
+		Return(&gate.CodeResponse{Code: gate.ResultCode_SUCCESS}, nil)
+	apr.On("Send", mock.Anything, mock.Anything, mock.Anything).
+		Return(&gate.CodeResponse{Code: gate.ResultCode_SUCCESS}, nil)
+
+	cfg := &Config{}
+	cfg.Vcas.Time.Layout = vcas.ISO8601
+	cfg.Vcas.Time.Zone = "UTC"
+
+	fmts, err := newFormats(cfg)
+	assert.Nil(t, err)
+
+	cli := newClient("test", &service{cli: apr, cfg: cfg, fmts: fmts})
+	cli.auth = true
+	cli.now = now
+	cli.format("")
+
+	err = receive(cli, []byte("time:2005-06-11T23:59:59.999+07:00|name:test|method:set|val:11.06|id:1\n"))
+
+	assert.Nil(t, err)
+	apr.AssertCalled(t, "Publish", mock.Anything, &gate.PublishRequest{
+		Conn:    "test",
+		Topic:   "test",
+		Payload: []byte(`{"timestamp":1118509199999,"value":"11.06"}`),
+	}, mock.Anything)
+	apr.AssertCalled(t, "Send", mock.Anything, &gate.SendBytesRequest{
+		Conn:  "test",
+		Bytes: []byte("time:2005-06-11T16:59:59.999Z|method:ack|name:test|val:11.06|descr:none|type:rw|units:none|id:1\n"),
+	}, mock.Anything)
+}
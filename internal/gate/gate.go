@@ -2,90 +2,449 @@ package gate
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log/slog"
+	"net/http"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/blabtm/emqx-gate/api"
-	"github.com/blabtm/emqx-gate/vcas"
 
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/credentials/insecure"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
 	"google.golang.org/grpc/status"
 )
 
 type Config struct {
 	Port int
+	Tls  TLS `mapstructure:"tls"`
+	Http struct {
+		Port int
+	} `mapstructure:"http"`
+	Shutdown struct {
+		Timeout time.Duration
+		Notify  bool
+	} `mapstructure:"shutdown"`
 	Emqx struct {
 		Adapter struct {
 			Host string
 			Port int
+			Tls  TLS `mapstructure:"tls"`
 		} `mapstructure:"adapter"`
+		Api struct {
+			Host   string
+			Port   int
+			Key    string
+			Secret string
+			Tls    TLS `mapstructure:"tls"`
+		} `mapstructure:"api"`
 	} `mapstructure:"emqx"`
+	Vcas struct {
+		Keepalive int
+		Ack       bool
+		Typing    string
+		Auth      struct {
+			Mode    string
+			Timeout int
+			Cert    struct {
+				Required bool
+				Clientid string
+				Username string
+			} `mapstructure:"cert"`
+		} `mapstructure:"auth"`
+		Get struct {
+			Timeout time.Duration
+		} `mapstructure:"get"`
+		Cache struct {
+			Enabled bool
+			Age     time.Duration
+		} `mapstructure:"cache"`
+		Time struct {
+			Layout string
+			Zone   string
+			Rules  []TimeRule
+		} `mapstructure:"time"`
+		Send struct {
+			Queue    int
+			Batch    int
+			Overflow string
+			Timeout  time.Duration
+		} `mapstructure:"send"`
+		Loop struct {
+			Inbox   int
+			Timeout time.Duration
+		} `mapstructure:"loop"`
+		Session struct {
+			Store  string
+			Path   string
+			Expiry time.Duration
+		} `mapstructure:"session"`
+		Mapping  Mapping
+		Policies []Policy
+	} `mapstructure:"vcas"`
 }
 
-func Register(srv *grpc.Server, cfg *Config) error {
+// Policy sets delivery options for the topics matching the Topic filter.
+// The first matching policy wins.
+type Policy struct {
+	Topic string
+	Pub   struct {
+		Qos    uint32
+		Retain bool
+	} `mapstructure:"pub"`
+	Sub struct {
+		Qos uint32
+	} `mapstructure:"sub"`
+}
+
+var defaultPolicy = func() Policy {
+	pol := Policy{Topic: "#"}
+	pol.Sub.Qos = 2
+
+	return pol
+}()
+
+const (
+	authAnonymous = "anonymous"
+	authLogin     = "login"
+
+	typingText    = "text"
+	typingLenient = "lenient"
+	typingStrict  = "strict"
+)
+
+// Gate is the gateway registered with a gRPC server.
+type Gate struct {
+	svc  *service
+	hc   *health
+	con  *grpc.ClientConn
+	stop context.CancelFunc
+}
+
+// Register adds the ConnectionUnaryHandler and grpc.health.v1 services to srv
+// and, unless mux is nil, the metrics and health endpoints to mux.
+func Register(srv *grpc.Server, mux *http.ServeMux, cfg *Config) (*Gate, error) {
+	switch cfg.Vcas.Auth.Mode {
+	case "", authAnonymous, authLogin:
+	default:
+		return nil, fmt.Errorf("auth: unknown mode: %v", cfg.Vcas.Auth.Mode)
+	}
+
+	switch cfg.Vcas.Typing {
+	case "", typingText, typingLenient, typingStrict:
+	default:
+		return nil, fmt.Errorf("typing: unknown mode: %v", cfg.Vcas.Typing)
+	}
+
+	switch cfg.Vcas.Send.Overflow {
+	case "", overflowDropOldest, overflowDropNewest, overflowLatest, overflowDisconnect:
+	default:
+		return nil, fmt.Errorf("send: unknown overflow policy: %v", cfg.Vcas.Send.Overflow)
+	}
+
+	for _, pol := range cfg.Vcas.Policies {
+		if pol.Pub.Qos > 2 || pol.Sub.Qos > 2 {
+			return nil, fmt.Errorf("policy: %v: invalid qos", pol.Topic)
+		}
+	}
+
+	fmts, err := newFormats(cfg)
+
+	if err != nil {
+		return nil, err
+	}
+
+	mpr, err := newMapper(&cfg.Vcas.Mapping)
+
+	if err != nil {
+		return nil, fmt.Errorf("mapping: %w", err)
+	}
+
+	ses, err := newStore(cfg)
+
+	if err != nil {
+		return nil, err
+	}
+
+	var ret retainer
+
+	for _, pol := range cfg.Vcas.Policies {
+		if !pol.Pub.Retain {
+			continue
+		}
+
+		if ret, err = newRest(cfg); err != nil {
+			return nil, err
+		}
+
+		break
+	}
+
+	creds, err := dialCreds(cfg)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if creds == nil {
+		creds = insecure.NewCredentials()
+	}
+
 	con, err := grpc.NewClient(fmt.Sprintf("%s:%d",
 		cfg.Emqx.Adapter.Host,
 		cfg.Emqx.Adapter.Port,
-	), grpc.WithTransportCredentials(insecure.NewCredentials()))
+	), grpc.WithTransportCredentials(creds))
 
 	if err != nil {
-		return fmt.Errorf("grpc: %w", err)
+		return nil, fmt.Errorf("grpc: %w", err)
 	}
 
 	cli := api.NewConnectionAdapterClient(con)
-	svc := &service{cli: cli}
+	svc := &service{cli: cli, cfg: cfg, fmts: fmts, mpr: mpr, ses: ses, ret: ret}
+
+	if cfg.Vcas.Cache.Enabled {
+		svc.lvc = newCache(cfg.Vcas.Cache.Age)
+	}
+
+	ctx, stop := context.WithCancel(context.Background())
+	hc := newHealth(con)
+
+	go hc.watch(ctx)
 
 	api.RegisterConnectionUnaryHandlerServer(srv, svc)
+	healthpb.RegisterHealthServer(srv, hc.srv)
 
-	return nil
+	if mux != nil {
+		mux.HandleFunc("GET /metrics", svc.metrics)
+		mux.HandleFunc("GET /healthz", hc.healthz)
+		mux.HandleFunc("GET /readyz", hc.readyz)
+	}
+
+	return &Gate{svc: svc, hc: hc, con: con, stop: stop}, nil
+}
+
+// Shutdown reports the gateway as not serving, rejects new sockets and lets
+// the served ones finish their pending get requests and queued sends before
+// closing them. It returns once they are closed or ctx is done.
+func (g *Gate) Shutdown(ctx context.Context) {
+	g.hc.srv.Shutdown()
+	g.stop()
+	g.svc.shutdown(ctx)
+}
+
+// Close closes the connection to the EMQX ConnectionAdapter.
+func (g *Gate) Close() error {
+	return g.con.Close()
 }
 
 type service struct {
 	dat sync.Map
 	cli api.ConnectionAdapterClient
+	cfg *Config
+	lvc *cache
+	ret retainer
+
+	fmts []format
+	mpr  *mapper
+	ses  store
+
+	// closing is set once the gateway is shutting down.
+	closing atomic.Bool
 
 	api.UnimplementedConnectionUnaryHandlerServer
 }
 
 func (s *service) OnSocketCreated(ctx context.Context, req *api.SocketCreatedRequest) (*api.EmptySuccess, error) {
-	res, err := s.cli.Authenticate(ctx, &api.AuthenticateRequest{
-		Conn: req.Conn,
-		Clientinfo: &api.ClientInfo{
-			ProtoName: vcas.Name,
-			ProtoVer:  vcas.Version,
-			Clientid:  req.Conn,
-			Username:  req.Conn,
-		},
-	})
+	if s.closing.Load() {
+		slog.Info("authn", "con", req.Conn, "err", errShutdown)
+		s.cli.Close(ctx, &api.CloseSocketRequest{Conn: req.Conn})
+
+		return nil, status.Error(codes.Unavailable, errShutdown.Error())
+	}
+
+	cli := newClient(req.Conn, s)
+	cli.port = req.GetConninfo().GetSockname().GetPort()
+	cli.format("")
+
+	info, err := s.identify(req)
 
 	if err != nil {
 		slog.Error("authn", "con", req.Conninfo.String(), "err", err)
 		s.cli.Close(ctx, &api.CloseSocketRequest{Conn: req.Conn})
+		cli.close(ctx)
 
-		return nil, status.Error(codes.Internal, err.Error())
+		return nil, status.Error(codes.Unauthenticated, err.Error())
 	}
 
-	if res.Code != api.ResultCode_SUCCESS {
-		slog.Error("authn", "con", req.Conninfo.String(), "code", res.Code)
-		s.cli.Close(ctx, &api.CloseSocketRequest{Conn: req.Conn})
+	if info == nil && s.cfg.Vcas.Auth.Mode == authLogin {
+		cli.await(time.Duration(s.cfg.Vcas.Auth.Timeout) * time.Second)
+	} else {
+		if info == nil {
+			info = &api.ClientInfo{
+				Clientid: req.Conn,
+				Username: req.Conn,
+			}
+		}
+
+		err := cli.call(ctx, func(ctx context.Context) error {
+			return cli.authenticate(ctx, info, "")
+		})
+
+		if err != nil {
+			slog.Error("authn", "con", req.Conninfo.String(), "err", err)
+			s.cli.Close(ctx, &api.CloseSocketRequest{Conn: req.Conn})
+			cli.close(ctx)
+
+			if errors.Is(err, errDenied) {
+				return nil, status.Error(codes.Unauthenticated, err.Error())
+			}
 
-		return nil, status.Error(codes.Unauthenticated, res.Message)
+			return nil, status.Error(codes.Internal, err.Error())
+		}
 	}
 
-	s.dat.Store(req.Conn, newClient(req.Conn, s.cli))
+	s.dat.Store(req.Conn, cli)
+
+	// A shutdown that started meanwhile may have missed the client, whoever
+	// takes it out of dat closes it.
+	if s.closing.Load() {
+		if _, ok := s.dat.LoadAndDelete(req.Conn); ok {
+			slog.Info("authn", "con", req.Conn, "err", errShutdown)
+			cli.disconnect(ctx)
+			cli.close(ctx)
+
+			return nil, status.Error(codes.Unavailable, errShutdown.Error())
+		}
+	}
 
 	return &api.EmptySuccess{}, nil
 }
 
-func (s *service) OnSocketClosed(_ context.Context, req *api.SocketClosedRequest) (*api.EmptySuccess, error) {
-	s.dat.Delete(req.Conn)
+// identify derives the client identity from the peer certificate of a TLS
+// socket. It returns nil when no certificate mapping applies.
+func (s *service) identify(req *api.SocketCreatedRequest) (*api.ClientInfo, error) {
+	cfg := &s.cfg.Vcas.Auth.Cert
+	crt := req.GetConninfo().GetPeercert()
+
+	switch req.GetConninfo().GetSocktype() {
+	case api.SocketType_SSL, api.SocketType_DTLS:
+	default:
+		crt = nil
+	}
+
+	if crt == nil || (crt.Cn == "" && crt.Dn == "") {
+		if cfg.Required {
+			return nil, fmt.Errorf("cert: not found")
+		}
+
+		return nil, nil
+	}
+
+	slog.Info("cert", "con", req.Conn, "cn", crt.Cn, "dn", crt.Dn)
+
+	if cfg.Clientid == "" && cfg.Username == "" {
+		return nil, nil
+	}
+
+	rep := strings.NewReplacer("{cn}", crt.Cn, "{dn}", crt.Dn, "{conn}", req.Conn)
+	info := &api.ClientInfo{
+		Clientid: rep.Replace(cfg.Clientid),
+		Username: rep.Replace(cfg.Username),
+	}
+
+	if info.Clientid == "" {
+		info.Clientid = req.Conn
+	}
+
+	return info, nil
+}
+
+func (s *service) OnSocketClosed(ctx context.Context, req *api.SocketClosedRequest) (*api.EmptySuccess, error) {
+	if v, ok := s.dat.LoadAndDelete(req.Conn); ok {
+		slog.Info("close", "con", req.Conn, "reason", req.Reason, "subs", len(v.(*client).Subscriptions()))
+		v.(*client).close(ctx)
+	}
 
 	return &api.EmptySuccess{}, nil
 }
 
+// shutdown stops accepting sockets and winds the served ones down: each client
+// finishes its pending work, then its socket is closed and its session saved.
+func (s *service) shutdown(ctx context.Context) {
+	s.closing.Store(true)
+
+	wg := sync.WaitGroup{}
+
+	s.dat.Range(func(k, v any) bool {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			cli := v.(*client)
+
+			if err := cli.finish(ctx, s.cfg.Shutdown.Notify); err != nil {
+				slog.Error("shutdown", "con", cli.conn, "err", err)
+			}
+
+			// The socket is closed and the session saved even if ctx is done
+			// already, the close is still bounded by its own timeout. The
+			// subscriptions go with the socket, so none is released.
+			ctx := context.WithoutCancel(ctx)
+			cli.disconnect(ctx)
+
+			if _, ok := s.dat.LoadAndDelete(k); ok {
+				cli.abandon(ctx)
+			}
+		}()
+
+		return true
+	})
+
+	wg.Wait()
+}
+
+// connections returns the number of sockets the gateway serves.
+func (s *service) connections() float64 {
+	n := 0
+
+	s.dat.Range(func(any, any) bool {
+		n++
+		return true
+	})
+
+	return float64(n)
+}
+
+func (s *service) metrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+
+	err := writeMetrics(w, &gauge{
+		name: "vcas_connections",
+		help: "Sockets currently served by the gateway.",
+		fn:   s.connections,
+	})
+
+	if err != nil {
+		slog.Debug("metrics", "err", err)
+	}
+}
+
+// Subscriptions returns the filters the connection conn is subscribed to,
+// or nil when there is no such connection.
+func (s *service) Subscriptions(conn string) []string {
+	if v, ok := s.dat.Load(conn); ok {
+		return v.(*client).Subscriptions()
+	}
+
+	return nil
+}
+
 func (s *service) OnReceivedBytes(ctx context.Context, req *api.ReceivedBytesRequest) (*api.EmptySuccess, error) {
 	v, ok := s.dat.Load(req.Conn)
 
@@ -94,7 +453,7 @@ func (s *service) OnReceivedBytes(ctx context.Context, req *api.ReceivedBytesReq
 	}
 
 	if err := v.(*client).OnReceivedBytes(ctx, req.Bytes); err != nil {
-		slog.Error("bytes", "con", req.Conn, "pay", string(req.Bytes), "err", err)
+		slog.Error("bytes", "con", req.Conn, "err", err)
 		return nil, status.Error(codes.Unknown, err.Error())
 	}
 
@@ -102,6 +461,17 @@ func (s *service) OnReceivedBytes(ctx context.Context, req *api.ReceivedBytesReq
 }
 
 func (s *service) OnTimerTimeout(ctx context.Context, req *api.TimerTimeoutRequest) (*api.EmptySuccess, error) {
+	if req.Type != api.TimerType_KEEPALIVE {
+		return &api.EmptySuccess{}, nil
+	}
+
+	slog.Info("keepalive", "con", req.Conn)
+
+	if _, err := s.cli.Close(ctx, &api.CloseSocketRequest{Conn: req.Conn}); err != nil {
+		slog.Error("close", "con", req.Conn, "err", err)
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
 	return &api.EmptySuccess{}, nil
 }
 
@@ -114,7 +484,7 @@ func (s *service) OnReceivedMessages(ctx context.Context, req *api.ReceivedMessa
 
 	for _, msg := range req.Messages {
 		if err := c.(*client).OnReceivedMessage(ctx, msg); err != nil {
-			slog.Error("msg", "con", req.Conn, "pay", msg, "err", err)
+			slog.Error("msg", "con", req.Conn, "err", err)
 			return nil, status.Error(codes.Unknown, err.Error())
 		}
 	}
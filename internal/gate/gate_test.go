@@ -0,0 +1,396 @@
+package gate
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+	_ "time/tzdata"
+
+	gate "github.com/blabtm/emqx-gate/api"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// TestMain sets the local zone that clients without a time rule get, the
+// expected lines carry timestamps in it.
+func TestMain(m *testing.M) {
+	loc, err := time.LoadLocation("Asia/Novosibirsk")
+
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "zone:", err)
+		os.Exit(1)
+	}
+
+	time.Local = loc
+
+	os.Exit(m.Run())
+}
+
+func TestOnSocketCreated(t *testing.T) {
+	cases := map[string]struct {
+		cfg   func(*Config)
+		req   *gate.SocketCreatedRequest
+		auth  *gate.AuthenticateRequest
+		timer *gate.TimerRequest
+		code  gate.ResultCode
+		err   bool
+	}{
+		`without keepalive`: {
+			req: &gate.SocketCreatedRequest{Conn: "test"},
+			auth: &gate.AuthenticateRequest{
+				Conn: "test",
+				Clientinfo: &gate.ClientInfo{
+					ProtoName: "VCAS",
+					ProtoVer:  "1.0-SNAPSHOT",
+					Clientid:  "test",
+					Username:  "test",
+				},
+			},
+		},
+		`with keepalive`: {
+			cfg: func(cfg *Config) {
+				cfg.Vcas.Keepalive = 30
+			},
+			req: &gate.SocketCreatedRequest{Conn: "test"},
+			auth: &gate.AuthenticateRequest{
+				Conn: "test",
+				Clientinfo: &gate.ClientInfo{
+					ProtoName: "VCAS",
+					ProtoVer:  "1.0-SNAPSHOT",
+					Clientid:  "test",
+					Username:  "test",
+				},
+			},
+			timer: &gate.TimerRequest{
+				Conn:     "test",
+				Type:     gate.TimerType_KEEPALIVE,
+				Interval: 30,
+			},
+		},
+		`with login`: {
+			cfg: func(cfg *Config) {
+				cfg.Vcas.Keepalive = 30
+				cfg.Vcas.Auth.Mode = "login"
+			},
+			req: &gate.SocketCreatedRequest{Conn: "test"},
+		},
+		`with cert`: {
+			cfg: func(cfg *Config) {
+				cfg.Vcas.Auth.Mode = "login"
+				cfg.Vcas.Auth.Cert.Clientid = "{cn}"
+				cfg.Vcas.Auth.Cert.Username = "{dn}"
+			},
+			req: &gate.SocketCreatedRequest{
+				Conn: "test",
+				Conninfo: &gate.ConnInfo{
+					Socktype: gate.SocketType_SSL,
+					Peercert: &gate.CertificateInfo{Cn: "dev01", Dn: "CN=dev01,O=lab"},
+				},
+			},
+			auth: &gate.AuthenticateRequest{
+				Conn: "test",
+				Clientinfo: &gate.ClientInfo{
+					ProtoName: "VCAS",
+					ProtoVer:  "1.0-SNAPSHOT",
+					Clientid:  "dev01",
+					Username:  "CN=dev01,O=lab",
+				},
+			},
+		},
+		`with cert over tcp`: {
+			cfg: func(cfg *Config) {
+				cfg.Vcas.Auth.Cert.Clientid = "{cn}"
+			},
+			req: &gate.SocketCreatedRequest{
+				Conn: "test",
+				Conninfo: &gate.ConnInfo{
+					Socktype: gate.SocketType_TCP,
+					Peercert: &gate.CertificateInfo{Cn: "dev01"},
+				},
+			},
+			auth: &gate.AuthenticateRequest{
+				Conn: "test",
+				Clientinfo: &gate.ClientInfo{
+					ProtoName: "VCAS",
+					ProtoVer:  "1.0-SNAPSHOT",
+					Clientid:  "test",
+					Username:  "test",
+				},
+			},
+		},
+		`without required cert`: {
+			cfg: func(cfg *Config) {
+				cfg.Vcas.Auth.Cert.Required = true
+				cfg.Vcas.Auth.Cert.Clientid = "{cn}"
+			},
+			req: &gate.SocketCreatedRequest{
+				Conn:     "test",
+				Conninfo: &gate.ConnInfo{Socktype: gate.SocketType_SSL},
+			},
+			err: true,
+		},
+		`with denial`: {
+			req: &gate.SocketCreatedRequest{Conn: "test"},
+			auth: &gate.AuthenticateRequest{
+				Conn: "test",
+				Clientinfo: &gate.ClientInfo{
+					ProtoName: "VCAS",
+					ProtoVer:  "1.0-SNAPSHOT",
+					Clientid:  "test",
+					Username:  "test",
+				},
+			},
+			code: gate.ResultCode_PERMISSION_DENY,
+			err:  true,
+		},
+	}
+
+	for n, c := range cases {
+		t.Run(n, func(t *testing.T) {
+			apr := &adapterMock{}
+
+			apr.On("Authenticate", mock.Anything, c.auth, mock.Anything).
+				Return(&gate.CodeResponse{Code: c.code}, nil)
+			apr.On("StartTimer", mock.Anything, c.timer, mock.Anything).
+				Return(&gate.CodeResponse{Code: gate.ResultCode_SUCCESS}, nil)
+			apr.On("Close", mock.Anything, mock.Anything, mock.Anything).
+				Return(&gate.CodeResponse{Code: gate.ResultCode_SUCCESS}, nil)
+
+			cfg := &Config{}
+
+			if c.cfg != nil {
+				c.cfg(cfg)
+			}
+
+			svc := &service{cli: apr, cfg: cfg}
+			_, err := svc.OnSocketCreated(context.Background(), c.req)
+
+			if c.err {
+				assert.NotNil(t, err)
+				apr.AssertCalled(t, "Close", mock.Anything, &gate.CloseSocketRequest{Conn: c.req.Conn}, mock.Anything)
+				return
+			}
+
+			assert.Nil(t, err)
+			apr.AssertNotCalled(t, "Close", mock.Anything, mock.Anything, mock.Anything)
+
+			if c.auth != nil {
+				apr.AssertCalled(t, "Authenticate", mock.Anything, c.auth, mock.Anything)
+			} else {
+				apr.AssertNotCalled(t, "Authenticate", mock.Anything, mock.Anything, mock.Anything)
+			}
+
+			if c.timer != nil {
+				apr.AssertCalled(t, "StartTimer", mock.Anything, c.timer, mock.Anything)
+			} else {
+				apr.AssertNotCalled(t, "StartTimer", mock.Anything, mock.Anything, mock.Anything)
+			}
+
+			_, ok := svc.dat.Load(c.req.Conn)
+			assert.True(t, ok)
+		})
+	}
+}
+
+func TestOnTimerTimeout(t *testing.T) {
+	apr := &adapterMock{}
+
+	apr.On("Close", mock.Anything, mock.Anything, mock.Anything).
+		Return(&gate.CodeResponse{Code: gate.ResultCode_SUCCESS}, nil)
+
+	svc := &service{cli: apr, cfg: &Config{}}
+	_, err := svc.OnTimerTimeout(context.Background(), &gate.TimerTimeoutRequest{
+		Conn: "test",
+		Type: gate.TimerType_KEEPALIVE,
+	})
+
+	assert.Nil(t, err)
+	apr.AssertCalled(t, "Close", mock.Anything, &gate.CloseSocketRequest{Conn: "test"}, mock.Anything)
+}
+
+func TestOnSocketClosed(t *testing.T) {
+	apr := &adapterMock{}
+
+	apr.On("Authenticate", mock.Anything, mock.Anything, mock.Anything).
+		Return(&gate.CodeResponse{Code: gate.ResultCode_SUCCESS}, nil)
+	apr.On("Subscribe", mock.Anything, mock.Anything, mock.Anything).
+		Return(&gate.CodeResponse{Code: gate.ResultCode_SUCCESS}, nil)
+	apr.On("Unsubscribe", mock.Anything, mock.Anything, mock.Anything).
+		Return(&gate.CodeResponse{Code: gate.ResultCode_SUCCESS}, nil)
+
+	svc := &service{cli: apr, cfg: &Config{}}
+
+	_, err := svc.OnSocketCreated(context.Background(), &gate.SocketCreatedRequest{Conn: "test"})
+	assert.Nil(t, err)
+
+	_, err = svc.OnReceivedBytes(context.Background(), &gate.ReceivedBytesRequest{
+		Conn:  "test",
+		Bytes: []byte("name:a|method:subscribe\nname:b/#|method:psubscribe\n"),
+	})
+
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"a", "b/#"}, svc.Subscriptions("test"))
+
+	_, err = svc.OnSocketClosed(context.Background(), &gate.SocketClosedRequest{Conn: "test"})
+
+	assert.Nil(t, err)
+	assert.Nil(t, svc.Subscriptions("test"))
+	apr.AssertCalled(t, "Unsubscribe", mock.Anything, &gate.UnsubscribeRequest{Conn: "test", Topic: "a"}, mock.Anything)
+	apr.AssertCalled(t, "Unsubscribe", mock.Anything, &gate.UnsubscribeRequest{Conn: "test", Topic: "b/#"}, mock.Anything)
+}
+
+func TestShutdown(t *testing.T) {
+	apr := &adapterMock{}
+
+	apr.On("Authenticate", mock.Anything, mock.Anything, mock.Anything).
+		Return(&gate.CodeResponse{Code: gate.ResultCode_SUCCESS}, nil)
+	apr.On("Subscribe", mock.Anything, mock.Anything, mock.Anything).
+		Return(&gate.CodeResponse{Code: gate.ResultCode_SUCCESS}, nil)
+	apr.On("Unsubscribe", mock.Anything, mock.Anything, mock.Anything).
+		Return(&gate.CodeResponse{Code: gate.ResultCode_SUCCESS}, nil)
+	apr.On("Send", mock.Anything, mock.Anything, mock.Anything).
+		Return(&gate.CodeResponse{Code: gate.ResultCode_SUCCESS}, nil)
+	apr.On("Close", mock.Anything, mock.Anything, mock.Anything).
+		Return(&gate.CodeResponse{Code: gate.ResultCode_SUCCESS}, nil)
+
+	cfg := &Config{}
+	cfg.Shutdown.Notify = true
+	cfg.Vcas.Get.Timeout = time.Hour
+
+	svc := &service{cli: apr, cfg: cfg}
+	ctx := context.Background()
+
+	for _, conn := range []string{"a", "b"} {
+		_, err := svc.OnSocketCreated(ctx, &gate.SocketCreatedRequest{Conn: conn})
+		assert.Nil(t, err)
+	}
+
+	_, err := svc.OnReceivedBytes(ctx, &gate.ReceivedBytesRequest{Conn: "a", Bytes: []byte("name:x|method:get\n")})
+	assert.Nil(t, err)
+
+	done := make(chan struct{})
+
+	go func() {
+		svc.shutdown(ctx)
+		close(done)
+	}()
+
+	assert.Eventually(t, svc.closing.Load, time.Second, time.Millisecond)
+
+	_, err = svc.OnSocketCreated(ctx, &gate.SocketCreatedRequest{Conn: "c"})
+	assert.Equal(t, codes.Unavailable, status.Code(err))
+
+	select {
+	case <-done:
+		t.Fatal("shut down with a get pending")
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	_, err = svc.OnReceivedMessages(ctx, &gate.ReceivedMessagesRequest{Conn: "a", Messages: []*gate.Message{{
+		Topic:   "x",
+		Payload: []byte(`{"value":"1"}`),
+	}}})
+	assert.Nil(t, err)
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("shutdown did not finish")
+	}
+
+	notice := func(conn string) any {
+		return mock.MatchedBy(func(req *gate.SendBytesRequest) bool {
+			return req.Conn == conn && bytes.Contains(req.Bytes, []byte("|method:error|name:none|code:CONN_PROCESS_NOT_ALIVE|msg:gateway shutting down"))
+		})
+	}
+
+	apr.AssertCalled(t, "Send", mock.Anything, mock.MatchedBy(func(req *gate.SendBytesRequest) bool {
+		return req.Conn == "a" && bytes.Contains(req.Bytes, []byte("|method:set|name:x|val:1|"))
+	}), mock.Anything)
+	apr.AssertCalled(t, "Send", mock.Anything, notice("a"), mock.Anything)
+	apr.AssertCalled(t, "Send", mock.Anything, notice("b"), mock.Anything)
+	apr.AssertNumberOfCalls(t, "Send", 3)
+
+	for _, conn := range []string{"a", "b", "c"} {
+		apr.AssertCalled(t, "Close", mock.Anything, &gate.CloseSocketRequest{Conn: conn}, mock.Anything)
+	}
+
+	assert.Zero(t, svc.connections())
+}
+
+func TestShutdownSession(t *testing.T) {
+	apr := &adapterMock{}
+
+	apr.On("Authenticate", mock.Anything, mock.Anything, mock.Anything).
+		Return(&gate.CodeResponse{Code: gate.ResultCode_SUCCESS}, nil)
+	apr.On("Subscribe", mock.Anything, mock.Anything, mock.Anything).
+		Return(&gate.CodeResponse{Code: gate.ResultCode_SUCCESS}, nil)
+	apr.On("Unsubscribe", mock.Anything, mock.Anything, mock.Anything).
+		Return(&gate.CodeResponse{Code: gate.ResultCode_SUCCESS}, nil)
+	apr.On("Close", mock.Anything, mock.Anything, mock.Anything).
+		Return(&gate.CodeResponse{Code: gate.ResultCode_SUCCESS}, nil)
+
+	cfg := &Config{}
+	cfg.Vcas.Auth.Mode = authLogin
+
+	ses := newMemStore(time.Hour)
+	svc := &service{cli: apr, cfg: cfg, ses: ses}
+
+	cli := newClient("a", svc)
+	cli.now = now
+
+	svc.dat.Store("a", cli)
+
+	err := receive(cli, []byte("name:dev01|method:login|user:operator\nname:x|method:subscribe\nname:y/+|method:psubscribe\n"))
+	assert.Nil(t, err)
+
+	svc.shutdown(context.Background())
+
+	apr.AssertCalled(t, "Close", mock.Anything, &gate.CloseSocketRequest{Conn: "a"}, mock.Anything)
+	apr.AssertNotCalled(t, "Unsubscribe", mock.Anything, mock.Anything, mock.Anything)
+
+	res, err := ses.Load("dev01", now())
+
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"x", "y/+"}, res.Subs)
+	assert.Zero(t, svc.connections())
+}
+
+func TestShutdownCreated(t *testing.T) {
+	apr := &adapterMock{}
+	started := make(chan struct{})
+	release := make(chan struct{})
+
+	apr.On("Authenticate", mock.Anything, mock.Anything, mock.Anything).
+		Run(func(mock.Arguments) {
+			close(started)
+			<-release
+		}).
+		Return(&gate.CodeResponse{Code: gate.ResultCode_SUCCESS}, nil)
+	apr.On("Close", mock.Anything, mock.Anything, mock.Anything).
+		Return(&gate.CodeResponse{Code: gate.ResultCode_SUCCESS}, nil)
+
+	svc := &service{cli: apr, cfg: &Config{}}
+	ctx := context.Background()
+	res := make(chan error)
+
+	go func() {
+		_, err := svc.OnSocketCreated(ctx, &gate.SocketCreatedRequest{Conn: "a"})
+		res <- err
+	}()
+
+	<-started
+	svc.shutdown(ctx)
+	close(release)
+
+	assert.Equal(t, codes.Unavailable, status.Code(<-res))
+	apr.AssertCalled(t, "Close", mock.Anything, &gate.CloseSocketRequest{Conn: "a"}, mock.Anything)
+	assert.Zero(t, svc.connections())
+}
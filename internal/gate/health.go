@@ -0,0 +1,87 @@
+package gate
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/blabtm/emqx-gate/api"
+
+	"google.golang.org/grpc/connectivity"
+	grpchealth "google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+// adapter is the connection to the EMQX ConnectionAdapter, which the gateway
+// cannot serve without.
+type adapter interface {
+	GetState() connectivity.State
+	WaitForStateChange(ctx context.Context, s connectivity.State) bool
+	Connect()
+}
+
+// health reports the gateway as serving while its adapter connection is
+// ready, both through grpc.health.v1 and over HTTP.
+type health struct {
+	con adapter
+	srv *grpchealth.Server
+}
+
+// services are the grpc.health.v1 service names the gateway answers for,
+// the empty one standing for the server as a whole.
+var services = []string{"", api.ConnectionUnaryHandler_ServiceDesc.ServiceName}
+
+func newHealth(con adapter) *health {
+	h := &health{con: con, srv: grpchealth.NewServer()}
+	h.set(con.GetState())
+
+	return h
+}
+
+// watch follows the state of the adapter connection until ctx is done. An
+// idle connection is asked to reconnect, so that readiness reflects whether
+// EMQX is reachable rather than whether the gateway has been used lately.
+func (h *health) watch(ctx context.Context) {
+	for {
+		st := h.con.GetState()
+		h.set(st)
+
+		if st == connectivity.Idle {
+			h.con.Connect()
+		}
+
+		if !h.con.WaitForStateChange(ctx, st) {
+			return
+		}
+	}
+}
+
+func (h *health) set(st connectivity.State) {
+	res := healthpb.HealthCheckResponse_NOT_SERVING
+
+	if st == connectivity.Ready {
+		res = healthpb.HealthCheckResponse_SERVING
+	}
+
+	for _, name := range services {
+		h.srv.SetServingStatus(name, res)
+	}
+}
+
+// healthz answers as long as the process is able to serve HTTP at all.
+func (h *health) healthz(w http.ResponseWriter, r *http.Request) {
+	fmt.Fprintln(w, "ok")
+}
+
+// readyz answers 503 unless the gateway is serving, with the state of the
+// adapter connection in the body.
+func (h *health) readyz(w http.ResponseWriter, r *http.Request) {
+	res, err := h.srv.Check(r.Context(), &healthpb.HealthCheckRequest{})
+
+	if err != nil || res.Status != healthpb.HealthCheckResponse_SERVING {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+
+	fmt.Fprintln(w, strings.ToLower(h.con.GetState().String()))
+}
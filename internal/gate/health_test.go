@@ -0,0 +1,127 @@
+package gate
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"google.golang.org/grpc/connectivity"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+// connMock is an adapter connection whose state is set by the test.
+type connMock struct {
+	mux   sync.Mutex
+	st    connectivity.State
+	chg   chan struct{}
+	conns int
+}
+
+func newConnMock(st connectivity.State) *connMock {
+	return &connMock{st: st, chg: make(chan struct{})}
+}
+
+func (c *connMock) set(st connectivity.State) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	c.st = st
+	close(c.chg)
+	c.chg = make(chan struct{})
+}
+
+func (c *connMock) GetState() connectivity.State {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	return c.st
+}
+
+func (c *connMock) WaitForStateChange(ctx context.Context, st connectivity.State) bool {
+	c.mux.Lock()
+
+	if c.st != st {
+		c.mux.Unlock()
+		return true
+	}
+
+	chg := c.chg
+	c.mux.Unlock()
+
+	select {
+	case <-chg:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+func (c *connMock) Connect() {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	c.conns++
+}
+
+func TestHealth(t *testing.T) {
+	con := newConnMock(connectivity.Idle)
+	hc := newHealth(con)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	go hc.watch(ctx)
+
+	status := func() healthpb.HealthCheckResponse_ServingStatus {
+		res, err := hc.srv.Check(ctx, &healthpb.HealthCheckRequest{Service: services[1]})
+		assert.Nil(t, err)
+
+		return res.Status
+	}
+
+	ready := func() (int, string) {
+		res := httptest.NewRecorder()
+		hc.readyz(res, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+
+		return res.Code, res.Body.String()
+	}
+
+	assert.Eventually(t, func() bool {
+		con.mux.Lock()
+		defer con.mux.Unlock()
+
+		return con.conns == 1
+	}, time.Second, time.Millisecond)
+
+	assert.Equal(t, healthpb.HealthCheckResponse_NOT_SERVING, status())
+
+	con.set(connectivity.Ready)
+
+	assert.Eventually(t, func() bool {
+		return status() == healthpb.HealthCheckResponse_SERVING
+	}, time.Second, time.Millisecond)
+
+	code, body := ready()
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "ready\n", body)
+
+	con.set(connectivity.TransientFailure)
+
+	assert.Eventually(t, func() bool {
+		return status() == healthpb.HealthCheckResponse_NOT_SERVING
+	}, time.Second, time.Millisecond)
+
+	code, body = ready()
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	assert.Equal(t, "transient_failure\n", body)
+
+	res := httptest.NewRecorder()
+	hc.healthz(res, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+
+	assert.Equal(t, http.StatusOK, res.Code)
+}
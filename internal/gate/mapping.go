@@ -0,0 +1,276 @@
+package gate
+
+import (
+	"fmt"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// Mapping translates vcas names into MQTT topics and back. A name matching
+// one of the rules is rewritten by the first such rule, any other name has
+// the substitutions applied and is prefixed with Prefix.
+type Mapping struct {
+	Prefix string
+	Subst  []Subst
+	Rules  []MapRule
+}
+
+// Subst replaces From in names with To in topics. All substitutions are
+// applied at once, so To strings must not occur in names for the mapping to
+// be reversible.
+type Subst struct {
+	From string
+	To   string
+}
+
+// MapRule rewrites names matching the Name template into the Topic template
+// and back. Templates are literal text with {var} placeholders, which may
+// restrict their values with a regular expression as in {var:\d+}. Both
+// templates must use the same placeholders.
+type MapRule struct {
+	Name  string
+	Topic string
+}
+
+type mapper struct {
+	prefix string
+	enc    *strings.Replacer
+	dec    *strings.Replacer
+	rules  []mapRule
+}
+
+type mapRule struct {
+	name  *template
+	topic *template
+}
+
+func newMapper(cfg *Mapping) (*mapper, error) {
+	m := &mapper{prefix: cfg.Prefix}
+
+	if len(cfg.Subst) > 0 {
+		enc := make([]string, 0, 2*len(cfg.Subst))
+		dec := make([]string, 0, 2*len(cfg.Subst))
+
+		for _, sub := range cfg.Subst {
+			if sub.From == "" || sub.To == "" {
+				return nil, fmt.Errorf("subst: empty: %q -> %q", sub.From, sub.To)
+			}
+
+			enc = append(enc, sub.From, sub.To)
+			dec = append(dec, sub.To, sub.From)
+		}
+
+		m.enc = strings.NewReplacer(enc...)
+		m.dec = strings.NewReplacer(dec...)
+	}
+
+	for _, rule := range cfg.Rules {
+		name, err := newTemplate(rule.Name)
+
+		if err != nil {
+			return nil, fmt.Errorf("rule: %v: %w", rule.Name, err)
+		}
+
+		top, err := newTemplate(rule.Topic)
+
+		if err != nil {
+			return nil, fmt.Errorf("rule: %v: %w", rule.Topic, err)
+		}
+
+		if !slices.Equal(slices.Sorted(slices.Values(name.vars)), slices.Sorted(slices.Values(top.vars))) {
+			return nil, fmt.Errorf("rule: %v: placeholders differ from %v", rule.Name, rule.Topic)
+		}
+
+		m.rules = append(m.rules, mapRule{name: name, topic: top})
+	}
+
+	return m, nil
+}
+
+// topic returns the MQTT topic of the vcas name. A nil mapper keeps names
+// as they are.
+func (m *mapper) topic(name string) string {
+	return m.rewrite(name, false)
+}
+
+func (m *mapper) rewrite(name string, wild bool) string {
+	if m == nil {
+		return name
+	}
+
+	for _, rule := range m.rules {
+		if vals, ok := rule.name.match(name, wild); ok {
+			return rule.topic.expand(vals)
+		}
+	}
+
+	if m.enc != nil {
+		name = m.enc.Replace(name)
+	}
+
+	return m.prefix + name
+}
+
+// name returns the vcas name of the MQTT topic. Topics outside of the
+// prefix are kept as they are.
+func (m *mapper) name(top string) string {
+	if m == nil {
+		return top
+	}
+
+	for _, rule := range m.rules {
+		if vals, ok := rule.topic.match(top, false); ok {
+			return rule.name.expand(vals)
+		}
+	}
+
+	name, ok := strings.CutPrefix(top, m.prefix)
+
+	if !ok {
+		return top
+	}
+
+	if m.dec != nil {
+		name = m.dec.Replace(name)
+	}
+
+	return name
+}
+
+var (
+	wild   = strings.NewReplacer("+", "\x00", "#", "\x01")
+	unwild = strings.NewReplacer("\x00", "+", "\x01", "#")
+)
+
+// filter returns the MQTT topic filter of the vcas name pattern, in which +
+// and # are wildcards rather than characters of the name. A wildcard matches
+// any rule placeholder.
+func (m *mapper) filter(pat string) string {
+	return unwild.Replace(m.rewrite(wild.Replace(pat), true))
+}
+
+// template is a string with {var} placeholders, matched by re and expanded
+// by interleaving lits with the values of vars. The wild expression also
+// lets placeholders take a single wildcard.
+type template struct {
+	re   *regexp.Regexp
+	wild *regexp.Regexp
+	lits []string
+	vars []string
+}
+
+func newTemplate(s string) (*template, error) {
+	t := &template{}
+	re := strings.Builder{}
+	wre := strings.Builder{}
+	lit := strings.Builder{}
+
+	re.WriteByte('^')
+	wre.WriteByte('^')
+
+	for i := 0; i < len(s); i++ {
+		if s[i] != '{' {
+			lit.WriteByte(s[i])
+			continue
+		}
+
+		end, depth := -1, 0
+
+		for j := i + 1; j < len(s) && end < 0; j++ {
+			switch s[j] {
+			case '{':
+				depth++
+			case '}':
+				if depth == 0 {
+					end = j
+				}
+
+				depth--
+			}
+		}
+
+		if end < 0 {
+			return nil, fmt.Errorf("placeholder: not closed")
+		}
+
+		v, pat, ok := strings.Cut(s[i+1:end], ":")
+
+		if !ok {
+			pat = ".+?"
+		}
+
+		if v == "" || slices.Contains(t.vars, v) {
+			return nil, fmt.Errorf("placeholder: invalid name: %q", v)
+		}
+
+		re.WriteString(regexp.QuoteMeta(lit.String()))
+		re.WriteString("(" + pat + ")")
+		wre.WriteString(regexp.QuoteMeta(lit.String()))
+		wre.WriteString("((?:" + pat + ")|\\x00|\\x01)")
+
+		t.lits = append(t.lits, lit.String())
+		t.vars = append(t.vars, v)
+
+		lit.Reset()
+
+		i = end
+	}
+
+	re.WriteString(regexp.QuoteMeta(lit.String()))
+	re.WriteByte('$')
+	wre.WriteString(regexp.QuoteMeta(lit.String()))
+	wre.WriteByte('$')
+
+	t.lits = append(t.lits, lit.String())
+
+	exp, err := regexp.Compile(re.String())
+
+	if err != nil {
+		return nil, err
+	}
+
+	if exp.NumSubexp() != len(t.vars) {
+		return nil, fmt.Errorf("placeholder: capturing groups are not allowed")
+	}
+
+	t.re = exp
+	t.wild = regexp.MustCompile(wre.String())
+
+	return t, nil
+}
+
+func (t *template) match(s string, wild bool) (map[string]string, bool) {
+	re := t.re
+
+	if wild {
+		re = t.wild
+	}
+
+	sub := re.FindStringSubmatch(s)
+
+	if sub == nil {
+		return nil, false
+	}
+
+	vals := make(map[string]string, len(t.vars))
+
+	for i, v := range t.vars {
+		vals[v] = sub[i+1]
+	}
+
+	return vals, true
+}
+
+func (t *template) expand(vals map[string]string) string {
+	buf := strings.Builder{}
+
+	for i, v := range t.vars {
+		buf.WriteString(t.lits[i])
+		buf.WriteString(vals[v])
+	}
+
+	buf.WriteString(t.lits[len(t.lits)-1])
+
+	return buf.String()
+}
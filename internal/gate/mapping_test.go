@@ -0,0 +1,117 @@
+package gate
+
+import (
+	"testing"
+
+	gate "github.com/blabtm/emqx-gate/api"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func TestMapper(t *testing.T) {
+	mpr, err := newMapper(&Mapping{
+		Prefix: "vepp/",
+		Subst: []Subst{
+			{From: "%", To: "%25"},
+			{From: "/", To: "%2F"},
+			{From: "+", To: "%2B"},
+			{From: "#", To: "%23"},
+			{From: ":", To: "/"},
+		},
+		Rules: []MapRule{
+			{Name: `RING:BPM:{n:\d+}:{axis:[XY]}`, Topic: "ring/bpm/{n}/{axis}"},
+			{Name: "{dev}.{attr}", Topic: "tango/{dev}/attr/{attr}"},
+		},
+	})
+
+	assert.Nil(t, err)
+
+	cases := map[string]struct {
+		name string
+		top  string
+	}{
+		`plain`:         {name: "test", top: "vepp/test"},
+		`separators`:    {name: "CCD:1M1L:sigma_x", top: "vepp/CCD/1M1L/sigma_x"},
+		`reserved`:      {name: "a/b+c#d%e", top: "vepp/a%2Fb%2Bc%23d%25e"},
+		`rule`:          {name: "RING:BPM:01:X", top: "ring/bpm/01/X"},
+		`rule mismatch`: {name: "RING:BPM:01:Z", top: "vepp/RING/BPM/01/Z"},
+		`second rule`:   {name: "sr/di/dcct.current", top: "tango/sr/di/dcct/attr/current"},
+	}
+
+	for n, c := range cases {
+		t.Run(n, func(t *testing.T) {
+			assert.Equal(t, c.top, mpr.topic(c.name))
+			assert.Equal(t, c.name, mpr.name(c.top))
+		})
+	}
+
+	assert.Equal(t, "other/test", mpr.name("other/test"))
+	assert.Equal(t, "vepp/CCD/+/sigma_x", mpr.filter("CCD:+:sigma_x"))
+	assert.Equal(t, "vepp/CCD/#", mpr.filter("CCD:#"))
+	assert.Equal(t, "ring/bpm/+/X", mpr.filter("RING:BPM:+:X"))
+}
+
+func TestMapperInvalid(t *testing.T) {
+	cases := map[string]*Mapping{
+		`empty subst`:       {Subst: []Subst{{From: ":"}}},
+		`unclosed`:          {Rules: []MapRule{{Name: "RING:{n", Topic: "ring/{n}"}}},
+		`different vars`:    {Rules: []MapRule{{Name: "RING:{n}", Topic: "ring/{m}"}}},
+		`duplicate vars`:    {Rules: []MapRule{{Name: "{n}:{n}", Topic: "{n}"}}},
+		`capturing group`:   {Rules: []MapRule{{Name: "{n:(X|Y)}", Topic: "{n}"}}},
+		`malformed pattern`: {Rules: []MapRule{{Name: "{n:[}", Topic: "{n}"}}},
+	}
+
+	for n, c := range cases {
+		t.Run(n, func(t *testing.T) {
+			_, err := newMapper(c)
+			assert.NotNil(t, err)
+		})
+	}
+}
+
+func TestMapping(t *testing.T) {
+	apr := &adapterMock{}
+
+	apr.On("Publish", mock.Anything, mock.Anything, mock.Anything).
+		Return(&gate.CodeResponse{Code: gate.ResultCode_SUCCESS}, nil)
+	apr.On("Subscribe", mock.Anything, mock.Anything, mock.Anything).
+		Return(&gate.CodeResponse{Code: gate.ResultCode_SUCCESS}, nil)
+	apr.On("Send", mock.Anything, mock.Anything, mock.Anything).
+		Return(&gate.CodeResponse{Code: gate.ResultCode_SUCCESS}, nil)
+
+	mpr, err := newMapper(&Mapping{Prefix: "vepp/", Subst: []Subst{{From: ":", To: "/"}}})
+	assert.Nil(t, err)
+
+	cli := newClient("test", &service{cli: apr, cfg: &Config{}, mpr: mpr})
+	cli.auth = true
+	cli.now = now
+
+	err = receive(cli, []byte(""+
+		"name:RING:BPM:01:X|method:set|val:11.06\n"+
+		"name:RING:BPM:01:Y|method:subscribe\n",
+	))
+
+	assert.Nil(t, err)
+	apr.AssertCalled(t, "Publish", mock.Anything, &gate.PublishRequest{
+		Conn:    "test",
+		Topic:   "vepp/RING/BPM/01/X",
+		Payload: []byte(`{"timestamp":1118509199999,"value":"11.06"}`),
+	}, mock.Anything)
+	apr.AssertCalled(t, "Subscribe", mock.Anything, &gate.SubscribeRequest{
+		Conn:  "test",
+		Topic: "vepp/RING/BPM/01/Y",
+		Qos:   2,
+	}, mock.Anything)
+
+	err = deliver(cli, &gate.Message{
+		Topic:   "vepp/RING/BPM/01/Y",
+		Payload: []byte(`{"timestamp":1118509199999,"value":0.5}`),
+	})
+
+	assert.Nil(t, err)
+	apr.AssertCalled(t, "Send", mock.Anything, &gate.SendBytesRequest{
+		Conn:  "test",
+		Bytes: []byte("time:11.06.2005 23_59_59.999|method:set|name:RING:BPM:01:Y|val:0.5|descr:none|type:rw|units:none\n"),
+	}, mock.Anything)
+}
@@ -0,0 +1,338 @@
+package gate
+
+import (
+	"io"
+	"maps"
+	"math"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/blabtm/emqx-gate/api"
+)
+
+// metric is written out in the Prometheus text exposition format.
+type metric interface {
+	collect(b []byte) []byte
+}
+
+// counter is a monotonically increasing metric split by labels.
+type counter struct {
+	name   string
+	help   string
+	labels []string
+
+	mux sync.RWMutex
+	dat map[string]*atomic.Uint64
+}
+
+func newCounter(name, help string, labels ...string) *counter {
+	return &counter{
+		name:   name,
+		help:   help,
+		labels: labels,
+		dat:    make(map[string]*atomic.Uint64),
+	}
+}
+
+func (c *counter) add(n uint64, vals ...string) {
+	key := strings.Join(vals, "\xff")
+
+	c.mux.RLock()
+	v, ok := c.dat[key]
+	c.mux.RUnlock()
+
+	if !ok {
+		c.mux.Lock()
+
+		if v, ok = c.dat[key]; !ok {
+			v = &atomic.Uint64{}
+			c.dat[key] = v
+		}
+
+		c.mux.Unlock()
+	}
+
+	v.Add(n)
+}
+
+func (c *counter) inc(vals ...string) {
+	c.add(1, vals...)
+}
+
+func (c *counter) get(vals ...string) uint64 {
+	c.mux.RLock()
+	defer c.mux.RUnlock()
+
+	if v, ok := c.dat[strings.Join(vals, "\xff")]; ok {
+		return v.Load()
+	}
+
+	return 0
+}
+
+func (c *counter) collect(b []byte) []byte {
+	b = header(b, c.name, c.help, "counter")
+
+	c.mux.RLock()
+	defer c.mux.RUnlock()
+
+	if len(c.labels) == 0 && len(c.dat) == 0 {
+		return sample(b, c.name, nil, nil, "", "", 0)
+	}
+
+	for _, key := range slices.Sorted(maps.Keys(c.dat)) {
+		b = sample(b, c.name, c.labels, split(key, len(c.labels)), "", "", float64(c.dat[key].Load()))
+	}
+
+	return b
+}
+
+// histogram counts observations in buckets with the upper bounds bounds,
+// split by labels.
+type histogram struct {
+	name   string
+	help   string
+	labels []string
+	bounds []float64
+
+	mux sync.Mutex
+	dat map[string]*series
+}
+
+type series struct {
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+func newHistogram(name, help string, bounds []float64, labels ...string) *histogram {
+	return &histogram{
+		name:   name,
+		help:   help,
+		labels: labels,
+		bounds: bounds,
+		dat:    make(map[string]*series),
+	}
+}
+
+func (h *histogram) observe(v float64, vals ...string) {
+	key := strings.Join(vals, "\xff")
+
+	h.mux.Lock()
+	defer h.mux.Unlock()
+
+	s, ok := h.dat[key]
+
+	if !ok {
+		s = &series{counts: make([]uint64, len(h.bounds))}
+		h.dat[key] = s
+	}
+
+	if i, _ := slices.BinarySearch(h.bounds, v); i < len(h.bounds) {
+		s.counts[i]++
+	}
+
+	s.sum += v
+	s.count++
+}
+
+// count returns the number of observations made with vals.
+func (h *histogram) count(vals ...string) uint64 {
+	h.mux.Lock()
+	defer h.mux.Unlock()
+
+	if s, ok := h.dat[strings.Join(vals, "\xff")]; ok {
+		return s.count
+	}
+
+	return 0
+}
+
+func (h *histogram) collect(b []byte) []byte {
+	b = header(b, h.name, h.help, "histogram")
+
+	h.mux.Lock()
+	defer h.mux.Unlock()
+
+	for _, key := range slices.Sorted(maps.Keys(h.dat)) {
+		s := h.dat[key]
+		vals := split(key, len(h.labels))
+		acc := uint64(0)
+
+		for i, le := range h.bounds {
+			acc += s.counts[i]
+			b = sample(b, h.name+"_bucket", h.labels, vals, "le", strconv.FormatFloat(le, 'g', -1, 64), float64(acc))
+		}
+
+		b = sample(b, h.name+"_bucket", h.labels, vals, "le", "+Inf", float64(s.count))
+		b = sample(b, h.name+"_sum", h.labels, vals, "", "", s.sum)
+		b = sample(b, h.name+"_count", h.labels, vals, "", "", float64(s.count))
+	}
+
+	return b
+}
+
+// gauge reports the value of fn at the time of collection.
+type gauge struct {
+	name string
+	help string
+	fn   func() float64
+}
+
+func (g *gauge) collect(b []byte) []byte {
+	b = header(b, g.name, g.help, "gauge")
+
+	return sample(b, g.name, nil, nil, "", "", g.fn())
+}
+
+func header(b []byte, name, help, typ string) []byte {
+	b = append(b, "# HELP "...)
+	b = append(b, name...)
+	b = append(b, ' ')
+	b = append(b, helpEscaper.Replace(help)...)
+	b = append(b, "\n# TYPE "...)
+	b = append(b, name...)
+	b = append(b, ' ')
+	b = append(b, typ...)
+
+	return append(b, '\n')
+}
+
+var (
+	helpEscaper  = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+	labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+)
+
+// sample writes a single sample line. The extra label, such as le of a
+// histogram bucket, is written after the others unless empty.
+func sample(b []byte, name string, labels, vals []string, extra, val string, v float64) []byte {
+	b = append(b, name...)
+
+	if len(labels) > 0 || extra != "" {
+		b = append(b, '{')
+
+		for i, l := range labels {
+			b = append(b, l...)
+			b = append(b, `="`...)
+			b = append(b, labelEscaper.Replace(vals[i])...)
+			b = append(b, `",`...)
+		}
+
+		if extra != "" {
+			b = append(b, extra...)
+			b = append(b, `="`...)
+			b = append(b, val...)
+			b = append(b, `",`...)
+		}
+
+		b[len(b)-1] = '}'
+	}
+
+	b = append(b, ' ')
+
+	switch {
+	case math.IsInf(v, 1):
+		b = append(b, "+Inf"...)
+	case math.IsInf(v, -1):
+		b = append(b, "-Inf"...)
+	default:
+		b = strconv.AppendFloat(b, v, 'g', -1, 64)
+	}
+
+	return append(b, '\n')
+}
+
+func split(key string, n int) []string {
+	if n == 0 {
+		return nil
+	}
+
+	return strings.SplitN(key, "\xff", n)
+}
+
+// writeMetrics writes every metric of the gateway followed by extra ones.
+func writeMetrics(w io.Writer, extra ...metric) error {
+	b := make([]byte, 0, 4<<10)
+
+	for _, m := range slices.Concat(registry, extra) {
+		b = m.collect(b)
+	}
+
+	_, err := w.Write(b)
+
+	return err
+}
+
+var (
+	latencyBuckets = []float64{.001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5}
+	sizeBuckets    = []float64{64, 256, 1024, 4096, 16384, 65536}
+)
+
+var (
+	sendDrops = newCounter(
+		"vcas_send_dropped_total",
+		"Lines dropped from full outbound queues.",
+		"policy",
+	)
+	sendBatches = newCounter(
+		"vcas_send_batches_total",
+		"SendBytes calls made by outbound queues.",
+		"result",
+	)
+	packetsIn = newCounter(
+		"vcas_packets_received_total",
+		"Packets received from clients.",
+		"method",
+	)
+	packetsOut = newCounter(
+		"vcas_packets_sent_total",
+		"Packets sent to clients.",
+		"method",
+	)
+	parseErrors = newCounter(
+		"vcas_parse_errors_total",
+		"Lines received from clients that failed to parse.",
+	)
+	getTimeouts = newCounter(
+		"vcas_get_timeouts_total",
+		"Get requests answered with no value after the timeout.",
+	)
+	receivedBytes = newHistogram(
+		"vcas_received_bytes",
+		"Size of the chunks of bytes received from sockets.",
+		sizeBuckets,
+	)
+	calls = newHistogram(
+		"vcas_adapter_call_duration_seconds",
+		"Duration of ConnectionAdapter calls by result code.",
+		latencyBuckets,
+		"call", "code",
+	)
+
+	registry = []metric{
+		packetsIn,
+		packetsOut,
+		parseErrors,
+		getTimeouts,
+		receivedBytes,
+		calls,
+		sendDrops,
+		sendBatches,
+	}
+)
+
+// observe records a ConnectionAdapter call started at beg. Calls that failed
+// to reach EMQX are recorded with code ERROR.
+func observe(call string, beg time.Time, res *api.CodeResponse, err error) {
+	code := "ERROR"
+
+	if err == nil {
+		code = res.Code.String()
+	}
+
+	calls.observe(time.Since(beg).Seconds(), call, code)
+}
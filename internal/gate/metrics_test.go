@@ -0,0 +1,108 @@
+package gate
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	gate "github.com/blabtm/emqx-gate/api"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func TestCounter(t *testing.T) {
+	c := newCounter("test_total", "Test\ncounter.", "a", "b")
+
+	c.inc("x", `"y"`)
+	c.add(2, "x", `"y"`)
+	c.inc("", "z")
+
+	assert.Equal(t, uint64(3), c.get("x", `"y"`))
+	assert.Equal(t, uint64(0), c.get("x", "z"))
+	assert.Equal(t, ""+
+		"# HELP test_total Test\\ncounter.\n"+
+		"# TYPE test_total counter\n"+
+		"test_total{a=\"x\",b=\"\\\"y\\\"\"} 3\n"+
+		"test_total{a=\"\",b=\"z\"} 1\n",
+		string(c.collect(nil)),
+	)
+
+	c = newCounter("test_total", "Test.")
+
+	assert.Equal(t, "# HELP test_total Test.\n# TYPE test_total counter\ntest_total 0\n", string(c.collect(nil)))
+
+	c.inc()
+
+	assert.Equal(t, "# HELP test_total Test.\n# TYPE test_total counter\ntest_total 1\n", string(c.collect(nil)))
+}
+
+func TestHistogram(t *testing.T) {
+	h := newHistogram("test_seconds", "Test.", []float64{.1, 1}, "call")
+
+	h.observe(.05, "a")
+	h.observe(.1, "a")
+	h.observe(.5, "a")
+	h.observe(2, "a")
+
+	assert.Equal(t, uint64(4), h.count("a"))
+	assert.Equal(t, ""+
+		"# HELP test_seconds Test.\n"+
+		"# TYPE test_seconds histogram\n"+
+		"test_seconds_bucket{call=\"a\",le=\"0.1\"} 2\n"+
+		"test_seconds_bucket{call=\"a\",le=\"1\"} 3\n"+
+		"test_seconds_bucket{call=\"a\",le=\"+Inf\"} 4\n"+
+		"test_seconds_sum{call=\"a\"} 2.65\n"+
+		"test_seconds_count{call=\"a\"} 4\n",
+		string(h.collect(nil)),
+	)
+}
+
+func TestMetrics(t *testing.T) {
+	apr := &adapterMock{}
+
+	apr.On("Authenticate", mock.Anything, mock.Anything, mock.Anything).
+		Return(&gate.CodeResponse{Code: gate.ResultCode_SUCCESS}, nil)
+	apr.On("Publish", mock.Anything, mock.Anything, mock.Anything).
+		Return(&gate.CodeResponse{Code: gate.ResultCode_PERMISSION_DENY}, nil)
+	apr.On("Send", mock.Anything, mock.Anything, mock.Anything).
+		Return(&gate.CodeResponse{Code: gate.ResultCode_SUCCESS}, nil)
+
+	svc := &service{cli: apr, cfg: &Config{}}
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /metrics", svc.metrics)
+
+	_, err := svc.OnSocketCreated(context.Background(), &gate.SocketCreatedRequest{Conn: "test"})
+	assert.Nil(t, err)
+
+	pubs := calls.count("publish", "PERMISSION_DENY")
+	sets := packetsIn.get("set")
+	errs := packetsOut.get("error")
+	bad := parseErrors.get()
+
+	_, err = svc.OnReceivedBytes(context.Background(), &gate.ReceivedBytesRequest{
+		Conn:  "test",
+		Bytes: []byte("name:a|method:set|val:1\nname:a|method:nope\n"),
+	})
+
+	assert.Nil(t, err)
+	assert.Empty(t, svc.Subscriptions("test"))
+	assert.Equal(t, pubs+1, calls.count("publish", "PERMISSION_DENY"))
+	assert.Equal(t, sets+1, packetsIn.get("set"))
+	assert.Equal(t, errs+2, packetsOut.get("error"))
+	assert.Equal(t, bad+1, parseErrors.get())
+
+	res := httptest.NewRecorder()
+	mux.ServeHTTP(res, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+
+	pay, err := io.ReadAll(res.Body)
+
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusOK, res.Code)
+	assert.True(t, bytes.Contains(pay, []byte("\nvcas_connections 1\n")))
+	assert.True(t, bytes.Contains(pay, []byte("\nvcas_adapter_call_duration_seconds_count{call=\"publish\",code=\"PERMISSION_DENY\"} ")))
+	assert.True(t, bytes.Contains(pay, []byte("\nvcas_packets_received_total{method=\"set\"} ")))
+}
@@ -0,0 +1,196 @@
+package gate
+
+import (
+	"context"
+	"slices"
+	"sync"
+)
+
+const (
+	overflowDropOldest = "drop-oldest"
+	overflowDropNewest = "drop-newest"
+	overflowLatest     = "latest"
+	overflowDisconnect = "disconnect"
+)
+
+// outbox is a bounded queue of vcas lines waiting to be sent to a client.
+type outbox struct {
+	mux  sync.Mutex
+	buf  []line
+	max  int
+	pol  string
+	wake chan struct{}
+
+	// busy is set while a popped batch is being sent, waits holds the
+	// channels of flush calls waiting for the queue to empty.
+	busy  bool
+	waits []chan struct{}
+}
+
+// line is a marshaled packet on channel top, which is empty for lines that
+// must never be coalesced, such as replies.
+type line struct {
+	top string
+	pay []byte
+}
+
+func newOutbox(max int, pol string) *outbox {
+	return &outbox{
+		buf:  make([]line, 0, min(max, 64)),
+		max:  max,
+		pol:  pol,
+		wake: make(chan struct{}, 1),
+	}
+}
+
+// push queues pay for top, applying the overflow policy when the queue is
+// full. Replies are never dropped: the oldest channel line makes room for
+// them instead. It returns false when the policy is to disconnect or when
+// nothing but replies is queued.
+func (o *outbox) push(top string, pay []byte) bool {
+	o.mux.Lock()
+	defer o.mux.Unlock()
+
+	if len(o.buf) >= o.max {
+		sendDrops.inc(o.pol)
+
+		switch o.pol {
+		case overflowDisconnect:
+			return false
+		case overflowDropNewest:
+			if top != "" {
+				return true
+			}
+		case overflowLatest:
+			if i := o.find(top); i >= 0 {
+				o.buf[i].pay = pay
+				return true
+			}
+		}
+
+		if !o.evict() {
+			return false
+		}
+	}
+
+	o.buf = append(o.buf, line{top: top, pay: pay})
+
+	select {
+	case o.wake <- struct{}{}:
+	default:
+	}
+
+	return true
+}
+
+// evict drops the oldest queued line that is not a reply.
+func (o *outbox) evict() bool {
+	i := slices.IndexFunc(o.buf, func(ln line) bool {
+		return ln.top != ""
+	})
+
+	if i < 0 {
+		return false
+	}
+
+	o.buf = slices.Delete(o.buf, i, i+1)
+
+	return true
+}
+
+// find returns the index of the last queued line on top.
+func (o *outbox) find(top string) int {
+	if top == "" {
+		return -1
+	}
+
+	for i := len(o.buf) - 1; i >= 0; i-- {
+		if o.buf[i].top == top {
+			return i
+		}
+	}
+
+	return -1
+}
+
+// pop removes as many queued lines as fit into size bytes, but at least
+// one, and returns them joined. It returns nil when the queue is empty. The
+// caller reports with sent once the batch is out.
+func (o *outbox) pop(size int) []byte {
+	o.mux.Lock()
+	defer o.mux.Unlock()
+
+	if len(o.buf) == 0 {
+		return nil
+	}
+
+	n, sum := 1, len(o.buf[0].pay)
+
+	for n < len(o.buf) && sum+len(o.buf[n].pay) <= size {
+		sum += len(o.buf[n].pay)
+		n++
+	}
+
+	pay := make([]byte, 0, sum)
+
+	for _, ln := range o.buf[:n] {
+		pay = append(pay, ln.pay...)
+	}
+
+	o.buf = append(o.buf[:0], o.buf[n:]...)
+	o.busy = true
+
+	return pay
+}
+
+// sent marks the batch returned by the last pop as sent.
+func (o *outbox) sent() {
+	o.mux.Lock()
+	defer o.mux.Unlock()
+
+	o.busy = false
+	o.settle()
+}
+
+// reset drops every queued line.
+func (o *outbox) reset() {
+	o.mux.Lock()
+	defer o.mux.Unlock()
+
+	clear(o.buf)
+	o.buf = o.buf[:0]
+	o.settle()
+}
+
+// flush waits until every queued line is sent or ctx is done.
+func (o *outbox) flush(ctx context.Context) error {
+	o.mux.Lock()
+
+	if len(o.buf) == 0 && !o.busy {
+		o.mux.Unlock()
+		return nil
+	}
+
+	ch := make(chan struct{})
+	o.waits = append(o.waits, ch)
+	o.mux.Unlock()
+
+	select {
+	case <-ch:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (o *outbox) settle() {
+	if len(o.buf) > 0 || o.busy {
+		return
+	}
+
+	for _, ch := range o.waits {
+		close(ch)
+	}
+
+	o.waits = nil
+}
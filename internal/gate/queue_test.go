@@ -0,0 +1,146 @@
+package gate
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOutbox(t *testing.T) {
+	tests := map[string]struct {
+		pol  string
+		push []line
+		ok   bool
+		want string
+	}{
+		`drop-oldest`: {
+			pol:  overflowDropOldest,
+			push: []line{{"c", []byte("c1\n")}},
+			ok:   true,
+			want: "b1\nr\nc1\n",
+		},
+		`drop-oldest replies`: {
+			pol:  overflowDropOldest,
+			push: []line{{"c", []byte("c1\n")}, {"d", []byte("d1\n")}},
+			ok:   true,
+			want: "r\nc1\nd1\n",
+		},
+		`drop-oldest replies only`: {
+			pol:  overflowDropOldest,
+			push: []line{{"", []byte("r1\n")}, {"", []byte("r2\n")}, {"", []byte("r3\n")}},
+			ok:   false,
+			want: "r\nr1\nr2\n",
+		},
+		`drop-newest`: {
+			pol:  overflowDropNewest,
+			push: []line{{"c", []byte("c1\n")}},
+			ok:   true,
+			want: "a1\nb1\nr\n",
+		},
+		`drop-newest reply`: {
+			pol:  overflowDropNewest,
+			push: []line{{"", []byte("r1\n")}},
+			ok:   true,
+			want: "b1\nr\nr1\n",
+		},
+		`latest`: {
+			pol:  overflowLatest,
+			push: []line{{"b", []byte("b2\n")}},
+			ok:   true,
+			want: "a1\nb2\nr\n",
+		},
+		`latest reply`: {
+			pol:  overflowLatest,
+			push: []line{{"", []byte("r1\n")}},
+			ok:   true,
+			want: "b1\nr\nr1\n",
+		},
+		`latest new channel`: {
+			pol:  overflowLatest,
+			push: []line{{"c", []byte("c1\n")}},
+			ok:   true,
+			want: "b1\nr\nc1\n",
+		},
+		`disconnect`: {
+			pol:  overflowDisconnect,
+			push: []line{{"c", []byte("c1\n")}},
+			ok:   false,
+			want: "a1\nb1\nr\n",
+		},
+	}
+
+	for n, test := range tests {
+		t.Run(n, func(t *testing.T) {
+			o := newOutbox(3, test.pol)
+			drops := sendDrops.get(test.pol)
+
+			assert.True(t, o.push("a", []byte("a1\n")))
+			assert.True(t, o.push("b", []byte("b1\n")))
+			assert.True(t, o.push("", []byte("r\n")))
+
+			for i, ln := range test.push {
+				assert.Equal(t, test.ok || i < len(test.push)-1, o.push(ln.top, ln.pay))
+			}
+
+			assert.Equal(t, test.want, string(o.pop(1<<10)))
+			assert.Nil(t, o.pop(1<<10))
+			assert.Equal(t, drops+uint64(len(test.push)), sendDrops.get(test.pol))
+		})
+	}
+}
+
+func TestOutboxPop(t *testing.T) {
+	o := newOutbox(8, overflowDropOldest)
+
+	o.push("a", []byte("aaaa\n"))
+	o.push("b", []byte("bb\n"))
+	o.push("c", []byte("c\n"))
+
+	assert.Equal(t, "aaaa\n", string(o.pop(2)))
+	assert.Equal(t, "bb\nc\n", string(o.pop(5)))
+	assert.Nil(t, o.pop(5))
+
+	o.push("a", []byte("a\n"))
+	o.reset()
+
+	assert.Nil(t, o.pop(5))
+}
+
+func TestOutboxFlush(t *testing.T) {
+	o := newOutbox(8, overflowDropOldest)
+	ctx := context.Background()
+
+	assert.Nil(t, o.flush(ctx))
+
+	o.push("a", []byte("a\n"))
+	o.push("b", []byte("b\n"))
+
+	done := make(chan error)
+
+	go func() {
+		done <- o.flush(ctx)
+	}()
+
+	o.pop(2)
+	o.sent()
+	o.pop(2)
+
+	select {
+	case <-done:
+		t.Fatal("flushed while a batch is being sent")
+	case <-time.After(10 * time.Millisecond):
+	}
+
+	o.sent()
+
+	assert.Nil(t, <-done)
+
+	o.push("c", []byte("c\n"))
+
+	tctx, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cancel()
+
+	assert.ErrorIs(t, o.flush(tctx), context.DeadlineExceeded)
+}
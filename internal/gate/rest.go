@@ -0,0 +1,103 @@
+package gate
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+)
+
+// retainer publishes retained messages. The ExProto adapter has no retain
+// flag, so these go through the EMQX REST API instead.
+type retainer interface {
+	Retain(ctx context.Context, top string, qos uint32, pay []byte) error
+}
+
+type rest struct {
+	url  string
+	key  string
+	sec  string
+	http *http.Client
+}
+
+// newRest returns the retainer of cfg, using HTTPS when the API has TLS
+// enabled.
+func newRest(cfg *Config) (*rest, error) {
+	api := &cfg.Emqx.Api
+
+	r := &rest{
+		url:  fmt.Sprintf("http://%s:%d/api/v5/publish", api.Host, api.Port),
+		key:  api.Key,
+		sec:  api.Secret,
+		http: http.DefaultClient,
+	}
+
+	if !api.Tls.Enabled {
+		return r, nil
+	}
+
+	src, err := newTLSSource(&api.Tls, false)
+
+	if err != nil {
+		return nil, fmt.Errorf("api: tls: %w", err)
+	}
+
+	r.url = fmt.Sprintf("https://%s:%d/api/v5/publish", api.Host, api.Port)
+	r.http = &http.Client{Transport: &http.Transport{
+		DialTLSContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			cfg, err := src.config()
+
+			if err != nil {
+				return nil, err
+			}
+
+			d := tls.Dialer{Config: cfg}
+
+			return d.DialContext(ctx, network, addr)
+		},
+	}}
+
+	return r, nil
+}
+
+func (r *rest) Retain(ctx context.Context, top string, qos uint32, pay []byte) error {
+	body, err := json.Marshal(map[string]any{
+		"topic":            top,
+		"qos":              qos,
+		"payload":          string(pay),
+		"payload_encoding": "plain",
+		"retain":           true,
+	})
+
+	if err != nil {
+		return fmt.Errorf("json: %w", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, r.url, bytes.NewReader(body))
+
+	if err != nil {
+		return fmt.Errorf("http: %w", err)
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	req.SetBasicAuth(r.key, r.sec)
+
+	res, err := r.http.Do(req)
+
+	if err != nil {
+		return fmt.Errorf("http: %w", err)
+	}
+
+	defer res.Body.Close()
+
+	if res.StatusCode/100 != 2 {
+		msg, _ := io.ReadAll(io.LimitReader(res.Body, 0xff))
+		return fmt.Errorf("http: %v: %s", res.Status, msg)
+	}
+
+	return nil
+}
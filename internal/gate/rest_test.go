@@ -0,0 +1,103 @@
+package gate
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRetain(t *testing.T) {
+	var body map[string]any
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key, sec, _ := r.BasicAuth()
+
+		if r.URL.Path != "/api/v5/publish" || key != "gate" || sec != "pass" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		json.NewDecoder(r.Body).Decode(&body)
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	defer srv.Close()
+
+	ret := &rest{url: srv.URL + "/api/v5/publish", key: "gate", sec: "pass", http: srv.Client()}
+	err := ret.Retain(context.Background(), "test", 1, []byte(`{"value":"11.06"}`))
+
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]any{
+		"topic":            "test",
+		"qos":              float64(1),
+		"payload":          `{"value":"11.06"}`,
+		"payload_encoding": "plain",
+		"retain":           true,
+	}, body)
+
+	ret.sec = "wrong"
+
+	assert.NotNil(t, ret.Retain(context.Background(), "test", 1, []byte(`{"value":"11.06"}`)))
+}
+
+func TestRetainTLS(t *testing.T) {
+	dir := t.TempDir()
+	ca := issue(t, "ca", nil)
+	bad := issue(t, "ca", nil)
+
+	assert.Nil(t, os.WriteFile(filepath.Join(dir, "ca.crt"), ca.pem, 0o600))
+	assert.Nil(t, os.WriteFile(filepath.Join(dir, "bad.crt"), bad.pem, 0o600))
+
+	crt := issue(t, "localhost", ca).write(t, dir, "srv")
+	pair, err := tls.LoadX509KeyPair(crt.Cert, crt.Key)
+	assert.Nil(t, err)
+
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	srv.TLS = &tls.Config{Certificates: []tls.Certificate{pair}}
+	srv.StartTLS()
+	defer srv.Close()
+
+	_, port, err := net.SplitHostPort(srv.Listener.Addr().String())
+	assert.Nil(t, err)
+
+	tests := map[string]struct {
+		ca string
+		ok bool
+	}{
+		`known server`: {
+			ca: filepath.Join(dir, "ca.crt"),
+			ok: true,
+		},
+		`unknown server`: {
+			ca: filepath.Join(dir, "bad.crt"),
+		},
+	}
+
+	for n, test := range tests {
+		t.Run(n, func(t *testing.T) {
+			cfg := &Config{}
+			cfg.Emqx.Api.Host = "localhost"
+			cfg.Emqx.Api.Port, _ = strconv.Atoi(port)
+			cfg.Emqx.Api.Tls = TLS{Enabled: true, Ca: test.ca}
+
+			ret, err := newRest(cfg)
+			assert.Nil(t, err)
+			assert.Equal(t, "https://localhost:"+port+"/api/v5/publish", ret.url)
+
+			err = ret.Retain(context.Background(), "test", 1, []byte(`{"value":"11.06"}`))
+			assert.Equal(t, test.ok, err == nil, "%v", err)
+		})
+	}
+}
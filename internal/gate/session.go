@@ -0,0 +1,191 @@
+package gate
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	storeMemory = "memory"
+	storeFile   = "file"
+)
+
+// session is what a client leaves behind when its socket closes.
+type session struct {
+	Subs []string  `json:"subs"`
+	At   time.Time `json:"at"`
+}
+
+// store keeps sessions by client id. Sessions saved longer than the expiry
+// ago are gone.
+type store interface {
+	Load(id string, now time.Time) (*session, error)
+	Save(id string, ses *session) error
+}
+
+func newStore(cfg *Config) (store, error) {
+	ses := &cfg.Vcas.Session
+
+	switch ses.Store {
+	case "":
+		return nil, nil
+	case storeMemory:
+		return newMemStore(ses.Expiry), nil
+	case storeFile:
+		return newFileStore(ses.Path, ses.Expiry, time.Now())
+	default:
+		return nil, fmt.Errorf("session: unknown store: %v", ses.Store)
+	}
+}
+
+func expired(ses *session, exp time.Duration, now time.Time) bool {
+	return exp > 0 && now.Sub(ses.At) > exp
+}
+
+type memStore struct {
+	mux sync.Mutex
+	dat map[string]session
+	exp time.Duration
+}
+
+func newMemStore(exp time.Duration) *memStore {
+	return &memStore{
+		dat: make(map[string]session),
+		exp: exp,
+	}
+}
+
+func (s *memStore) Load(id string, now time.Time) (*session, error) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	ses, ok := s.dat[id]
+
+	if !ok {
+		return nil, nil
+	}
+
+	if expired(&ses, s.exp, now) {
+		delete(s.dat, id)
+		return nil, nil
+	}
+
+	return &ses, nil
+}
+
+// Save also drops the sessions that expired by the time of ses.
+func (s *memStore) Save(id string, ses *session) error {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	for k, v := range s.dat {
+		if expired(&v, s.exp, ses.At) {
+			delete(s.dat, k)
+		}
+	}
+
+	s.dat[id] = *ses
+
+	return nil
+}
+
+// fileStore keeps every session in a JSON file of its own under dir.
+type fileStore struct {
+	dir string
+	exp time.Duration
+}
+
+// newFileStore creates dir if needed and removes the sessions that expired
+// by now.
+func newFileStore(dir string, exp time.Duration, now time.Time) (*fileStore, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("session: %w", err)
+	}
+
+	s := &fileStore{dir: dir, exp: exp}
+
+	ents, err := os.ReadDir(dir)
+
+	if err != nil {
+		return nil, fmt.Errorf("session: %w", err)
+	}
+
+	for _, ent := range ents {
+		id, ok := strings.CutSuffix(ent.Name(), ".json")
+
+		if !ok {
+			continue
+		}
+
+		if dec, err := base64.RawURLEncoding.DecodeString(id); err == nil {
+			_, _ = s.Load(string(dec), now)
+		}
+	}
+
+	return s, nil
+}
+
+func (s *fileStore) path(id string) string {
+	return filepath.Join(s.dir, base64.RawURLEncoding.EncodeToString([]byte(id))+".json")
+}
+
+func (s *fileStore) Load(id string, now time.Time) (*session, error) {
+	pay, err := os.ReadFile(s.path(id))
+
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	ses := &session{}
+
+	if err := json.Unmarshal(pay, ses); err != nil {
+		return nil, fmt.Errorf("json: %w", err)
+	}
+
+	if expired(ses, s.exp, now) {
+		return nil, os.Remove(s.path(id))
+	}
+
+	return ses, nil
+}
+
+// Save writes the session to a temporary file first, so that a crash never
+// leaves a truncated one behind.
+func (s *fileStore) Save(id string, ses *session) error {
+	pay, err := json.Marshal(ses)
+
+	if err != nil {
+		return fmt.Errorf("json: %w", err)
+	}
+
+	tmp, err := os.CreateTemp(s.dir, ".session-*")
+
+	if err != nil {
+		return err
+	}
+
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(pay); err != nil {
+		tmp.Close()
+		return err
+	}
+
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), s.path(id))
+}
@@ -0,0 +1,188 @@
+package gate
+
+import (
+	"context"
+	"os"
+	"testing"
+	"time"
+
+	gate "github.com/blabtm/emqx-gate/api"
+	"github.com/blabtm/emqx-gate/vcas"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func TestStore(t *testing.T) {
+	stores := map[string]func(t *testing.T) store{
+		`memory`: func(t *testing.T) store {
+			return newMemStore(time.Hour)
+		},
+		`file`: func(t *testing.T) store {
+			s, err := newFileStore(t.TempDir(), time.Hour, now())
+			assert.Nil(t, err)
+
+			return s
+		},
+	}
+
+	for n, mk := range stores {
+		t.Run(n, func(t *testing.T) {
+			s := mk(t)
+
+			ses, err := s.Load("dev/01", now())
+			assert.Nil(t, err)
+			assert.Nil(t, ses)
+
+			err = s.Save("dev/01", &session{Subs: []string{"a", "b/+"}, At: now()})
+			assert.Nil(t, err)
+
+			ses, err = s.Load("dev/01", now().Add(time.Minute))
+			assert.Nil(t, err)
+			assert.Equal(t, []string{"a", "b/+"}, ses.Subs)
+			assert.True(t, now().Equal(ses.At))
+
+			ses, err = s.Load("dev/01", now().Add(2*time.Hour))
+			assert.Nil(t, err)
+			assert.Nil(t, ses)
+
+			ses, err = s.Load("dev/01", now())
+			assert.Nil(t, err)
+			assert.Nil(t, ses)
+		})
+	}
+}
+
+func TestFileStorePrune(t *testing.T) {
+	dir := t.TempDir()
+
+	s, err := newFileStore(dir, time.Hour, now())
+	assert.Nil(t, err)
+	assert.Nil(t, s.Save("old", &session{Subs: []string{"a"}, At: now()}))
+	assert.Nil(t, s.Save("new", &session{Subs: []string{"a"}, At: now().Add(time.Hour)}))
+
+	_, err = newFileStore(dir, time.Hour, now().Add(90*time.Minute))
+	assert.Nil(t, err)
+
+	ents, err := os.ReadDir(dir)
+	assert.Nil(t, err)
+	assert.Len(t, ents, 1)
+}
+
+func TestSession(t *testing.T) {
+	apr := &adapterMock{}
+
+	apr.On("Authenticate", mock.Anything, mock.Anything, mock.Anything).
+		Return(&gate.CodeResponse{Code: gate.ResultCode_SUCCESS}, nil)
+	apr.On("Subscribe", mock.Anything, mock.Anything, mock.Anything).
+		Return(&gate.CodeResponse{Code: gate.ResultCode_SUCCESS}, nil)
+	apr.On("Unsubscribe", mock.Anything, mock.Anything, mock.Anything).
+		Return(&gate.CodeResponse{Code: gate.ResultCode_SUCCESS}, nil)
+	apr.On("Send", mock.Anything, mock.Anything, mock.Anything).
+		Return(&gate.CodeResponse{Code: gate.ResultCode_SUCCESS}, nil)
+
+	cfg := &Config{}
+	cfg.Vcas.Auth.Mode = authLogin
+
+	svc := &service{cli: apr, cfg: cfg, lvc: newCache(0), ses: newMemStore(time.Hour)}
+	ctx := context.Background()
+
+	connect := func(conn string) *client {
+		cli := newClient(conn, svc)
+		cli.now = now
+
+		err := receive(cli, []byte("name:dev01|method:login|user:operator\n"))
+		assert.Nil(t, err)
+
+		return cli
+	}
+
+	cli := connect("first")
+
+	err := receive(cli, []byte("name:a|method:subscribe\nname:b/+|method:psubscribe\nname:c|method:subscribe\nname:c|method:release\n"))
+	assert.Nil(t, err)
+
+	cli.close(ctx)
+
+	svc.lvc.store(&vcas.Packet{Topic: "a", Stamp: vcas.Time{Time: now()}, Value: "1"}, now())
+	svc.lvc.store(&vcas.Packet{Topic: "b/x", Stamp: vcas.Time{Time: now()}, Value: "2"}, now())
+	svc.lvc.store(&vcas.Packet{Topic: "c", Stamp: vcas.Time{Time: now()}, Value: "3"}, now())
+
+	cli = connect("second")
+
+	assert.Equal(t, []string{"a", "b/+"}, cli.Subscriptions())
+	apr.AssertCalled(t, "Subscribe", mock.Anything, &gate.SubscribeRequest{Conn: "second", Topic: "a", Qos: 2}, mock.Anything)
+	apr.AssertCalled(t, "Subscribe", mock.Anything, &gate.SubscribeRequest{Conn: "second", Topic: "b/+", Qos: 2}, mock.Anything)
+
+	for _, ln := range []string{
+		"time:11.06.2005 23_59_59.999|method:set|name:a|val:1|descr:none|type:rw|units:none\n",
+		"time:11.06.2005 23_59_59.999|method:set|name:b/x|val:2|descr:none|type:rw|units:none\n",
+	} {
+		apr.AssertCalled(t, "Send", mock.Anything, &gate.SendBytesRequest{Conn: "second", Bytes: []byte(ln)}, mock.Anything)
+	}
+
+	apr.AssertNumberOfCalls(t, "Send", 2)
+}
+
+func TestSessionPartial(t *testing.T) {
+	apr := &adapterMock{}
+
+	apr.On("Authenticate", mock.Anything, mock.Anything, mock.Anything).
+		Return(&gate.CodeResponse{Code: gate.ResultCode_SUCCESS}, nil)
+	apr.On("Subscribe", mock.Anything, mock.MatchedBy(func(req *gate.SubscribeRequest) bool {
+		return req.Topic == "b"
+	}), mock.Anything).
+		Return(&gate.CodeResponse{Code: gate.ResultCode_PERMISSION_DENY}, nil)
+	apr.On("Subscribe", mock.Anything, mock.Anything, mock.Anything).
+		Return(&gate.CodeResponse{Code: gate.ResultCode_SUCCESS}, nil)
+	apr.On("Unsubscribe", mock.Anything, mock.Anything, mock.Anything).
+		Return(&gate.CodeResponse{Code: gate.ResultCode_SUCCESS}, nil)
+	apr.On("Send", mock.Anything, mock.Anything, mock.Anything).
+		Return(&gate.CodeResponse{Code: gate.ResultCode_SUCCESS}, nil)
+
+	cfg := &Config{}
+	cfg.Vcas.Auth.Mode = authLogin
+
+	ses := newMemStore(time.Hour)
+	svc := &service{cli: apr, cfg: cfg, ses: ses}
+	ctx := context.Background()
+
+	assert.Nil(t, ses.Save("dev01", &session{Subs: []string{"a", "b", "c"}, At: now()}))
+
+	subs := func() []string {
+		s, err := ses.Load("dev01", now())
+		assert.Nil(t, err)
+
+		return s.Subs
+	}
+
+	connect := func(conn string) *client {
+		cli := newClient(conn, svc)
+		cli.now = now
+
+		err := receive(cli, []byte("name:dev01|method:login|user:operator\n"))
+		assert.Nil(t, err)
+
+		return cli
+	}
+
+	cli := connect("first")
+
+	assert.Equal(t, []string{"a", "c"}, cli.Subscriptions())
+
+	err := receive(cli, []byte("name:d|method:subscribe\n"))
+	assert.Nil(t, err)
+
+	cli.close(ctx)
+
+	assert.Equal(t, []string{"a", "b", "c", "d"}, subs())
+
+	cli = connect("second")
+
+	err = receive(cli, []byte("name:b|method:release\n"))
+	assert.Nil(t, err)
+
+	cli.close(ctx)
+
+	assert.Equal(t, []string{"a", "c", "d"}, subs())
+}
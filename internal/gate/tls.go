@@ -0,0 +1,254 @@
+package gate
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"strings"
+	"sync"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+)
+
+// TLS secures one side of a gRPC connection. Cert and Key are the own
+// certificate, required on the server side and enabling mutual
+// authentication on the client side. Ca is the bundle peers are verified
+// with, the system pool if empty on the client side. Mutual makes the server
+// require client certificates, Name overrides the server name the client
+// expects. The files are read again whenever they change on disk.
+type TLS struct {
+	Enabled bool
+	Cert    string
+	Key     string
+	Ca      string
+	Mutual  bool
+	Name    string
+}
+
+// ServerOptions returns the options of the gRPC server serving the
+// ConnectionUnaryHandler.
+func ServerOptions(cfg *Config) ([]grpc.ServerOption, error) {
+	if !cfg.Tls.Enabled {
+		return nil, nil
+	}
+
+	creds, err := newCreds(&cfg.Tls, true)
+
+	if err != nil {
+		return nil, fmt.Errorf("tls: %w", err)
+	}
+
+	return []grpc.ServerOption{grpc.Creds(creds)}, nil
+}
+
+// dialCreds returns the credentials of the ConnectionAdapter client.
+func dialCreds(cfg *Config) (credentials.TransportCredentials, error) {
+	if !cfg.Emqx.Adapter.Tls.Enabled {
+		return nil, nil
+	}
+
+	creds, err := newCreds(&cfg.Emqx.Adapter.Tls, false)
+
+	if err != nil {
+		return nil, fmt.Errorf("adapter: tls: %w", err)
+	}
+
+	return creds, nil
+}
+
+// tlsSource builds the TLS config of one side from its files and rebuilds it
+// once any of them changes.
+type tlsSource struct {
+	cfg    TLS
+	server bool
+
+	mux   sync.Mutex
+	stamp string
+	tls   *tls.Config
+}
+
+func newTLSSource(cfg *TLS, server bool) (*tlsSource, error) {
+	if (cfg.Cert == "") != (cfg.Key == "") {
+		return nil, fmt.Errorf("cert and key must be set together")
+	}
+
+	if server && cfg.Cert == "" {
+		return nil, fmt.Errorf("cert: not set")
+	}
+
+	if server && cfg.Mutual && cfg.Ca == "" {
+		return nil, fmt.Errorf("mutual: ca not set")
+	}
+
+	s := &tlsSource{cfg: *cfg, server: server}
+
+	if _, err := s.config(); err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// config returns the TLS config built from the current files. A change that
+// fails to load, e.g. a certificate renewed but not its key yet, keeps the
+// previous config.
+func (s *tlsSource) config() (*tls.Config, error) {
+	stamp, err := s.stat()
+
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	if err == nil && stamp == s.stamp {
+		return s.tls, nil
+	}
+
+	if err == nil {
+		var cfg *tls.Config
+
+		if cfg, err = s.load(); err == nil {
+			s.stamp, s.tls = stamp, cfg
+			return cfg, nil
+		}
+	}
+
+	if s.tls == nil {
+		return nil, err
+	}
+
+	slog.Error("tls", "cert", s.cfg.Cert, "err", err)
+
+	return s.tls, nil
+}
+
+// stat identifies the current version of the files.
+func (s *tlsSource) stat() (string, error) {
+	buf := strings.Builder{}
+
+	for _, name := range []string{s.cfg.Cert, s.cfg.Key, s.cfg.Ca} {
+		if name == "" {
+			continue
+		}
+
+		inf, err := os.Stat(name)
+
+		if err != nil {
+			return "", err
+		}
+
+		fmt.Fprintf(&buf, "%d:%d;", inf.ModTime().UnixNano(), inf.Size())
+	}
+
+	return buf.String(), nil
+}
+
+func (s *tlsSource) load() (*tls.Config, error) {
+	cfg := &tls.Config{MinVersion: tls.VersionTLS12}
+
+	if s.cfg.Cert != "" {
+		crt, err := tls.LoadX509KeyPair(s.cfg.Cert, s.cfg.Key)
+
+		if err != nil {
+			return nil, fmt.Errorf("cert: %w", err)
+		}
+
+		cfg.Certificates = []tls.Certificate{crt}
+	}
+
+	var pool *x509.CertPool
+
+	if s.cfg.Ca != "" {
+		pem, err := os.ReadFile(s.cfg.Ca)
+
+		if err != nil {
+			return nil, fmt.Errorf("ca: %w", err)
+		}
+
+		pool = x509.NewCertPool()
+
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("ca: no certificates: %v", s.cfg.Ca)
+		}
+	}
+
+	if !s.server {
+		cfg.RootCAs = pool
+		cfg.ServerName = s.cfg.Name
+
+		return cfg, nil
+	}
+
+	cfg.ClientCAs = pool
+
+	switch {
+	case s.cfg.Mutual:
+		cfg.ClientAuth = tls.RequireAndVerifyClientCert
+	case pool != nil:
+		cfg.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+
+	return cfg, nil
+}
+
+// creds are gRPC transport credentials that pick up the current TLS config
+// of their source on every handshake.
+type creds struct {
+	src *tlsSource
+}
+
+func newCreds(cfg *TLS, server bool) (*creds, error) {
+	src, err := newTLSSource(cfg, server)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &creds{src: src}, nil
+}
+
+func (c *creds) current() (credentials.TransportCredentials, error) {
+	cfg, err := c.src.config()
+
+	if err != nil {
+		return nil, err
+	}
+
+	return credentials.NewTLS(cfg), nil
+}
+
+func (c *creds) ClientHandshake(ctx context.Context, authority string, raw net.Conn) (net.Conn, credentials.AuthInfo, error) {
+	cur, err := c.current()
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return cur.ClientHandshake(ctx, authority, raw)
+}
+
+func (c *creds) ServerHandshake(raw net.Conn) (net.Conn, credentials.AuthInfo, error) {
+	cur, err := c.current()
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return cur.ServerHandshake(raw)
+}
+
+func (c *creds) Info() credentials.ProtocolInfo {
+	return credentials.ProtocolInfo{SecurityProtocol: "tls", SecurityVersion: "1.2"}
+}
+
+func (c *creds) Clone() credentials.TransportCredentials {
+	return &creds{src: c.src}
+}
+
+// OverrideServerName is deprecated in gRPC, the name is set with Name.
+func (c *creds) OverrideServerName(string) error {
+	return nil
+}
@@ -0,0 +1,238 @@
+package gate
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// issuer is a certificate with its key, able to sign others.
+type issuer struct {
+	crt *x509.Certificate
+	key *ecdsa.PrivateKey
+	pem []byte
+}
+
+func issue(t *testing.T, cn string, parent *issuer) *issuer {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.Nil(t, err)
+
+	serial, err := rand.Int(rand.Reader, big.NewInt(1<<62))
+	assert.Nil(t, err)
+
+	tmpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: cn},
+		DNSNames:     []string{cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+
+	signer, signKey := tmpl, key
+
+	if parent == nil {
+		tmpl.IsCA = true
+		tmpl.BasicConstraintsValid = true
+	} else {
+		signer, signKey = parent.crt, parent.key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, signer, &key.PublicKey, signKey)
+	assert.Nil(t, err)
+
+	crt, err := x509.ParseCertificate(der)
+	assert.Nil(t, err)
+
+	return &issuer{
+		crt: crt,
+		key: key,
+		pem: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+	}
+}
+
+// write stores the certificate of iss and its key in dir as name.crt and
+// name.key, and returns the TLS config using them.
+func (iss *issuer) write(t *testing.T, dir, name string) TLS {
+	der, err := x509.MarshalECPrivateKey(iss.key)
+	assert.Nil(t, err)
+
+	cfg := TLS{
+		Enabled: true,
+		Cert:    filepath.Join(dir, name+".crt"),
+		Key:     filepath.Join(dir, name+".key"),
+	}
+
+	assert.Nil(t, os.WriteFile(cfg.Cert, iss.pem, 0o600))
+	assert.Nil(t, os.WriteFile(cfg.Key, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), 0o600))
+
+	return cfg
+}
+
+func TestTLSInvalid(t *testing.T) {
+	dir := t.TempDir()
+	srv := issue(t, "localhost", nil).write(t, dir, "srv")
+
+	tests := map[string]struct {
+		cfg    TLS
+		server bool
+	}{
+		`server without cert`: {
+			cfg:    TLS{Enabled: true},
+			server: true,
+		},
+		`cert without key`: {
+			cfg: TLS{Enabled: true, Cert: srv.Cert},
+		},
+		`mutual without ca`: {
+			cfg:    TLS{Enabled: true, Cert: srv.Cert, Key: srv.Key, Mutual: true},
+			server: true,
+		},
+		`missing ca`: {
+			cfg: TLS{Enabled: true, Ca: filepath.Join(dir, "none.crt")},
+		},
+		`malformed ca`: {
+			cfg: TLS{Enabled: true, Ca: srv.Key},
+		},
+	}
+
+	for n, test := range tests {
+		t.Run(n, func(t *testing.T) {
+			_, err := newCreds(&test.cfg, test.server)
+			assert.NotNil(t, err)
+		})
+	}
+}
+
+func TestTLSHandshake(t *testing.T) {
+	dir := t.TempDir()
+	ca := issue(t, "ca", nil)
+	bad := issue(t, "ca", nil)
+
+	assert.Nil(t, os.WriteFile(filepath.Join(dir, "ca.crt"), ca.pem, 0o600))
+	assert.Nil(t, os.WriteFile(filepath.Join(dir, "bad.crt"), bad.pem, 0o600))
+
+	srv := issue(t, "localhost", ca).write(t, dir, "srv")
+	cli := issue(t, "emqx", ca).write(t, dir, "cli")
+	rogue := issue(t, "emqx", bad).write(t, dir, "rogue")
+
+	tests := map[string]struct {
+		srv TLS
+		cli TLS
+		ok  bool
+	}{
+		`server only`: {
+			srv: srv,
+			cli: TLS{Ca: filepath.Join(dir, "ca.crt")},
+			ok:  true,
+		},
+		`unknown server`: {
+			srv: srv,
+			cli: TLS{Ca: filepath.Join(dir, "bad.crt")},
+		},
+		`server name`: {
+			srv: srv,
+			cli: TLS{Ca: filepath.Join(dir, "ca.crt"), Name: "gate"},
+		},
+		`mutual`: {
+			srv: TLS{Cert: srv.Cert, Key: srv.Key, Ca: filepath.Join(dir, "ca.crt"), Mutual: true},
+			cli: TLS{Cert: cli.Cert, Key: cli.Key, Ca: filepath.Join(dir, "ca.crt")},
+			ok:  true,
+		},
+		`mutual without client cert`: {
+			srv: TLS{Cert: srv.Cert, Key: srv.Key, Ca: filepath.Join(dir, "ca.crt"), Mutual: true},
+			cli: TLS{Ca: filepath.Join(dir, "ca.crt")},
+		},
+		`mutual with unknown client`: {
+			srv: TLS{Cert: srv.Cert, Key: srv.Key, Ca: filepath.Join(dir, "ca.crt"), Mutual: true},
+			cli: TLS{Cert: rogue.Cert, Key: rogue.Key, Ca: filepath.Join(dir, "ca.crt")},
+		},
+	}
+
+	for n, test := range tests {
+		t.Run(n, func(t *testing.T) {
+			sc, err := newCreds(&test.srv, true)
+			assert.Nil(t, err)
+
+			cc, err := newCreds(&test.cli, false)
+			assert.Nil(t, err)
+
+			sraw, craw := net.Pipe()
+			defer sraw.Close()
+			defer craw.Close()
+
+			_ = sraw.SetDeadline(time.Now().Add(time.Second))
+			_ = craw.SetDeadline(time.Now().Add(time.Second))
+
+			serr := make(chan error, 1)
+
+			go func() {
+				_, _, err := sc.ServerHandshake(sraw)
+				serr <- err
+
+				if err != nil {
+					sraw.Close()
+				}
+			}()
+
+			con, _, cerr := cc.ClientHandshake(context.Background(), "localhost:9001", craw)
+
+			if cerr != nil {
+				craw.Close()
+			} else {
+				// With TLS 1.3 the server rejects client certificates only
+				// after the client is done, reading takes its alert.
+				go con.Read(make([]byte, 1))
+			}
+
+			assert.Equal(t, test.ok, cerr == nil && <-serr == nil)
+		})
+	}
+}
+
+func TestTLSReload(t *testing.T) {
+	dir := t.TempDir()
+	ca := issue(t, "ca", nil)
+	old := issue(t, "localhost", ca)
+	cfg := old.write(t, dir, "srv")
+
+	src, err := newTLSSource(&cfg, true)
+	assert.Nil(t, err)
+
+	serial := func() *big.Int {
+		cfg, err := src.config()
+		assert.Nil(t, err)
+
+		return cfg.Certificates[0].Leaf.SerialNumber
+	}
+
+	assert.Equal(t, old.crt.SerialNumber, serial())
+
+	renewed := issue(t, "localhost", ca)
+	renewed.write(t, dir, "srv")
+
+	later := time.Now().Add(time.Minute)
+	assert.Nil(t, os.Chtimes(cfg.Cert, later, later))
+
+	assert.Equal(t, renewed.crt.SerialNumber, serial())
+
+	assert.Nil(t, os.WriteFile(cfg.Cert, []byte("garbage"), 0o600))
+
+	later = later.Add(time.Minute)
+	assert.Nil(t, os.Chtimes(cfg.Cert, later, later))
+
+	assert.Equal(t, renewed.crt.SerialNumber, serial())
+}
@@ -0,0 +1,57 @@
+package gate
+
+import (
+	"strings"
+)
+
+// match reports whether top matches the MQTT topic filter flt.
+func match(flt, top string) bool {
+	if strings.HasPrefix(top, "$") && !strings.HasPrefix(flt, "$") {
+		return false
+	}
+
+	for {
+		f, fr, fok := strings.Cut(flt, "/")
+		t, tr, tok := strings.Cut(top, "/")
+
+		switch f {
+		case "#":
+			return true
+		case "+":
+		default:
+			if f != t {
+				return false
+			}
+		}
+
+		if !fok || !tok {
+			return !fok && !tok || fok && fr == "#"
+		}
+
+		flt, top = fr, tr
+	}
+}
+
+// valid reports whether flt is a well-formed MQTT topic filter, where
+// wildcards take whole levels and # may only be the last one.
+func valid(flt string) bool {
+	if flt == "" {
+		return false
+	}
+
+	lvls := strings.Split(flt, "/")
+
+	for i, lvl := range lvls {
+		switch {
+		case lvl == "#":
+			if i != len(lvls)-1 {
+				return false
+			}
+		case lvl == "+":
+		case strings.ContainsAny(lvl, "+#"):
+			return false
+		}
+	}
+
+	return true
+}
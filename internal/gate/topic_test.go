@@ -0,0 +1,57 @@
+package gate
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMatch(t *testing.T) {
+	cases := map[string]struct {
+		flt string
+		top string
+		exp bool
+	}{
+		`exact`:             {flt: "a/b/c", top: "a/b/c", exp: true},
+		`different`:         {flt: "a/b/c", top: "a/b/d"},
+		`shorter`:           {flt: "a/b", top: "a/b/c"},
+		`longer`:            {flt: "a/b/c", top: "a/b"},
+		`single level`:      {flt: "a/+/c", top: "a/b/c", exp: true},
+		`single level last`: {flt: "a/+", top: "a/b", exp: true},
+		`single level deep`: {flt: "a/+", top: "a/b/c"},
+		`single level void`: {flt: "a/+", top: "a/", exp: true},
+		`multi level`:       {flt: "a/#", top: "a/b/c", exp: true},
+		`multi level root`:  {flt: "#", top: "a/b", exp: true},
+		`multi level self`:  {flt: "a/#", top: "a", exp: true},
+		`system`:            {flt: "#", top: "$SYS/a"},
+		`system explicit`:   {flt: "$SYS/#", top: "$SYS/a", exp: true},
+	}
+
+	for n, c := range cases {
+		t.Run(n, func(t *testing.T) {
+			assert.Equal(t, c.exp, match(c.flt, c.top))
+		})
+	}
+}
+
+func TestValid(t *testing.T) {
+	cases := map[string]struct {
+		flt string
+		exp bool
+	}{
+		`plain`:             {flt: "a/b", exp: true},
+		`single level`:      {flt: "a/+/c", exp: true},
+		`multi level`:       {flt: "a/#", exp: true},
+		`root`:              {flt: "#", exp: true},
+		`empty`:             {flt: ""},
+		`partial single`:    {flt: "a/b+/c"},
+		`partial multi`:     {flt: "a/b#"},
+		`multi level inner`: {flt: "a/#/c"},
+	}
+
+	for n, c := range cases {
+		t.Run(n, func(t *testing.T) {
+			assert.Equal(t, c.exp, valid(c.flt))
+		})
+	}
+}
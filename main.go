@@ -1,13 +1,20 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"log"
 	"log/slog"
 	"net"
+	"net/http"
 	"os"
+	"os/signal"
 	"strings"
+	"syscall"
 
 	"github.com/blabtm/emqx-gate/internal/gate"
+	"github.com/blabtm/emqx-gate/vcas"
 	"github.com/spf13/viper"
 
 	"google.golang.org/grpc"
@@ -19,21 +26,83 @@ func main() {
 	})))
 
 	viper.SetDefault("port", 9001)
+	viper.SetDefault("tls.enabled", false)
+	viper.SetDefault("tls.cert", "")
+	viper.SetDefault("tls.key", "")
+	viper.SetDefault("tls.ca", "")
+	viper.SetDefault("tls.mutual", false)
+	viper.SetDefault("http.port", 0)
+	viper.SetDefault("shutdown.timeout", "30s")
+	viper.SetDefault("shutdown.notify", false)
 	viper.SetDefault("emqx.adapter.host", "emqx")
 	viper.SetDefault("emqx.adapter.port", 9100)
+	viper.SetDefault("emqx.adapter.tls.enabled", false)
+	viper.SetDefault("emqx.adapter.tls.cert", "")
+	viper.SetDefault("emqx.adapter.tls.key", "")
+	viper.SetDefault("emqx.adapter.tls.ca", "")
+	viper.SetDefault("emqx.adapter.tls.name", "")
+	viper.SetDefault("emqx.api.host", "emqx")
+	viper.SetDefault("emqx.api.port", 18083)
+	viper.SetDefault("emqx.api.key", "")
+	viper.SetDefault("emqx.api.secret", "")
+	viper.SetDefault("emqx.api.tls.enabled", false)
+	viper.SetDefault("emqx.api.tls.cert", "")
+	viper.SetDefault("emqx.api.tls.key", "")
+	viper.SetDefault("emqx.api.tls.ca", "")
+	viper.SetDefault("emqx.api.tls.name", "")
+	viper.SetDefault("vcas.keepalive", 0)
+	viper.SetDefault("vcas.ack", false)
+	viper.SetDefault("vcas.typing", "lenient")
+	viper.SetDefault("vcas.auth.mode", "anonymous")
+	viper.SetDefault("vcas.auth.timeout", 10)
+	viper.SetDefault("vcas.auth.cert.required", false)
+	viper.SetDefault("vcas.auth.cert.clientid", "")
+	viper.SetDefault("vcas.auth.cert.username", "")
+	viper.SetDefault("vcas.get.timeout", "5s")
+	viper.SetDefault("vcas.cache.enabled", true)
+	viper.SetDefault("vcas.cache.age", "0s")
+	viper.SetDefault("vcas.time.layout", vcas.Stamp)
+	viper.SetDefault("vcas.time.zone", "Local")
+	viper.SetDefault("vcas.send.queue", 1024)
+	viper.SetDefault("vcas.send.batch", 65536)
+	viper.SetDefault("vcas.send.overflow", "drop-oldest")
+	viper.SetDefault("vcas.send.timeout", "5s")
+	viper.SetDefault("vcas.loop.inbox", 64)
+	viper.SetDefault("vcas.loop.timeout", "5s")
+	viper.SetDefault("vcas.session.store", "")
+	viper.SetDefault("vcas.session.path", "/var/lib/emqx-gate/sessions")
+	viper.SetDefault("vcas.session.expiry", "1h")
 
 	viper.SetEnvKeyReplacer(strings.NewReplacer(".", "_"))
 	viper.AutomaticEnv()
 
+	viper.SetConfigName("gate")
+	viper.AddConfigPath("/etc/emqx-gate")
+	viper.AddConfigPath(".")
+
+	if err := viper.ReadInConfig(); err != nil {
+		if !errors.As(err, &viper.ConfigFileNotFoundError{}) {
+			log.Fatal(err)
+		}
+	}
+
 	cfg := &gate.Config{}
 
 	if err := viper.Unmarshal(cfg); err != nil {
 		log.Fatal(err)
 	}
 
-	srv := grpc.NewServer()
+	opts, err := gate.ServerOptions(cfg)
 
-	if err := gate.Register(srv, cfg); err != nil {
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	srv := grpc.NewServer(opts...)
+	mux := http.NewServeMux()
+	gw, err := gate.Register(srv, mux, cfg)
+
+	if err != nil {
 		log.Fatal(err)
 	}
 
@@ -51,7 +120,54 @@ func main() {
 		}
 	}
 
-	if err := srv.Serve(con); err != nil {
+	errs := make(chan error, 2)
+
+	go func() {
+		errs <- srv.Serve(con)
+	}()
+
+	web := &http.Server{Addr: fmt.Sprintf(":%d", cfg.Http.Port), Handler: mux}
+
+	if cfg.Http.Port > 0 {
+		go func() {
+			errs <- web.ListenAndServe()
+		}()
+	}
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGTERM, syscall.SIGINT)
+
+	select {
+	case err := <-errs:
 		log.Fatal(err)
+	case s := <-sig:
+		slog.Info("shutdown", "signal", s, "timeout", cfg.Shutdown.Timeout)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.Shutdown.Timeout)
+	defer cancel()
+
+	gw.Shutdown(ctx)
+
+	done := make(chan struct{})
+
+	go func() {
+		srv.GracefulStop()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-ctx.Done():
+		slog.Error("shutdown", "err", ctx.Err())
+		srv.Stop()
+	}
+
+	if err := web.Close(); err != nil {
+		slog.Error("http", "err", err)
+	}
+
+	if err := gw.Close(); err != nil {
+		slog.Error("grpc", "err", err)
 	}
 }
@@ -0,0 +1,65 @@
+package vcas
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Severity is the alarm severity of a channel. The zero value means that the
+// packet carries no alarm state.
+type Severity int
+
+const (
+	NoAlarm Severity = iota + 1
+	Minor
+	Major
+	Invalid
+)
+
+func (s Severity) String() string {
+	switch s {
+	case 0:
+		return ""
+	case NoAlarm:
+		return "NO_ALARM"
+	case Minor:
+		return "MINOR"
+	case Major:
+		return "MAJOR"
+	case Invalid:
+		return "INVALID"
+	default:
+		return fmt.Sprintf("severity(%d)", int(s))
+	}
+}
+
+func (s Severity) MarshalText() ([]byte, error) {
+	if s < 0 || s > Invalid {
+		return nil, fmt.Errorf("unknown: %v", s)
+	}
+
+	return []byte(s.String()), nil
+}
+
+// UnmarshalText accepts the severity names in any case as well as the EPICS
+// numeric codes 0 to 3.
+func (s *Severity) UnmarshalText(b []byte) error {
+	v := strings.ToUpper(string(b))
+
+	switch v {
+	case "", "NONE":
+		*s = 0
+	case "NO_ALARM", "0":
+		*s = NoAlarm
+	case "MINOR", "1":
+		*s = Minor
+	case "MAJOR", "2":
+		*s = Major
+	case "INVALID", "3":
+		*s = Invalid
+	default:
+		return fmt.Errorf("unknown: %v", string(b))
+	}
+
+	return nil
+}
@@ -0,0 +1,38 @@
+package vcas
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSeverity(t *testing.T) {
+	cases := map[string]struct {
+		inp string
+		err bool
+		res Severity
+	}{
+		`no alarm`: {inp: "NO_ALARM", res: NoAlarm},
+		`minor`:    {inp: "minor", res: Minor},
+		`major`:    {inp: "Major", res: Major},
+		`invalid`:  {inp: "INVALID", res: Invalid},
+		`numeric`:  {inp: "2", res: Major},
+		`none`:     {inp: "none"},
+		`unknown`:  {inp: "HIHI", err: true},
+	}
+
+	for name, data := range cases {
+		t.Run(name, func(t *testing.T) {
+			var res Severity
+
+			err := res.UnmarshalText([]byte(data.inp))
+
+			if !data.err {
+				assert.Nil(t, err)
+				assert.Equal(t, data.res, res)
+			} else {
+				assert.NotNil(t, err)
+			}
+		})
+	}
+}
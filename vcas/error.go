@@ -0,0 +1,135 @@
+package vcas
+
+import (
+	"bytes"
+	"fmt"
+)
+
+// Error is the reply sent to a client whose request failed. Method is the
+// method of the failed request, it is omitted from the line when unknown.
+// Nack marks the reply as a negative acknowledgement of request ID.
+type Error struct {
+	Method  Method
+	Stamp   Time
+	Topic   string
+	Code    string
+	Message string
+	ID      string
+	Nack    bool
+}
+
+func (e *Error) Marshal(pay []byte) ([]byte, error) {
+	return e.MarshalFormat(pay, nil)
+}
+
+// MarshalFormat is like Marshal but writes the timestamp in format f.
+func (e *Error) MarshalFormat(pay []byte, f *Format) ([]byte, error) {
+	if e.Code == "" {
+		return nil, fmt.Errorf("code: not found")
+	}
+
+	buf := bytes.NewBuffer(pay)
+
+	buf.Grow(63 + len(e.Topic) + len(e.Code) + len(e.Message))
+	buf.WriteString("time:")
+
+	if err := e.Stamp.marshal(buf, f); err != nil {
+		return nil, fmt.Errorf("time: %w", err)
+	}
+
+	if e.Nack {
+		buf.WriteString("|method:nack")
+	} else {
+		buf.WriteString("|method:error")
+	}
+
+	if e.Method != 0 {
+		buf.WriteString("|req:")
+
+		if err := e.Method.marshal(buf); err != nil {
+			return nil, fmt.Errorf("method: %w", err)
+		}
+	}
+
+	buf.WriteString("|name:")
+	escape(buf, orDefault(e.Topic, "none"))
+	buf.WriteString("|code:")
+	escape(buf, e.Code)
+	buf.WriteString("|msg:")
+	escape(buf, orDefault(e.Message, "none"))
+
+	if e.ID != "" {
+		buf.WriteString("|id:")
+		escape(buf, e.ID)
+	}
+
+	buf.WriteByte('\n')
+
+	return buf.Bytes(), nil
+}
+
+func (e *Error) Unmarshal(pay []byte) error {
+	return e.UnmarshalFormat(pay, nil)
+}
+
+// UnmarshalFormat is like Unmarshal but reads the timestamp in format f.
+func (e *Error) UnmarshalFormat(pay []byte, f *Format) error {
+	var res error
+
+	pay = trimEnd(pay)
+
+	for len(pay) > 0 {
+		var tok []byte
+
+		tok, pay = cut(pay, OuterSep)
+		key, val := cut(tok, InnerSep)
+
+		if val == nil {
+			continue
+		}
+
+		k := string(bytes.Trim(unescape(key), "\n\t\r "))
+		v := unescape(val)
+
+		switch k {
+		case "method", "meth", "m":
+			m := Method(0)
+
+			if err := m.unmarshal(v); err != nil || (m != ERR && m != NACK) {
+				res = fmt.Errorf("method: not an error")
+			}
+
+			e.Nack = m == NACK
+		case "req":
+			if err := e.Method.unmarshal(v); err != nil && res == nil {
+				res = fmt.Errorf("req: %w", err)
+			}
+		case "time", "t":
+			if err := e.Stamp.unmarshal(v, f); err != nil && res == nil {
+				res = fmt.Errorf("time: %w", err)
+			}
+		case "name", "n":
+			e.Topic = string(v)
+		case "code":
+			e.Code = string(v)
+		case "msg", "message":
+			e.Message = string(v)
+		case "id":
+			e.ID = string(v)
+		}
+	}
+
+	if e.Topic == "none" {
+		e.Topic = ""
+	}
+
+	if e.Message == "none" {
+		e.Message = ""
+	}
+
+	return res
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%v: %v", e.Code, e.Message)
+}
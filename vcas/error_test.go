@@ -0,0 +1,122 @@
+package vcas
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestErrorMarshal(t *testing.T) {
+	cases := map[string]struct {
+		inp Error
+		err bool
+		res string
+	}{
+		`with method`: {
+			inp: Error{
+				Method:  PUB,
+				Stamp:   Time{time.UnixMilli(1118509199999)},
+				Topic:   "test",
+				Code:    "PERMISSION_DENY",
+				Message: "not allowed|at all",
+			},
+			res: "time:11.06.2005 23_59_59.999|method:error|req:set|name:test|code:PERMISSION_DENY|msg:not allowed\\|at all\n",
+		},
+		`without method`: {
+			inp: Error{
+				Stamp: Time{time.UnixMilli(1118509199999)},
+				Code:  "PARAMS_TYPE_ERROR",
+			},
+			res: "time:11.06.2005 23_59_59.999|method:error|name:none|code:PARAMS_TYPE_ERROR|msg:none\n",
+		},
+		`with nack`: {
+			inp: Error{
+				Method:  PUB,
+				Stamp:   Time{time.UnixMilli(1118509199999)},
+				Topic:   "test",
+				Code:    "PERMISSION_DENY",
+				Message: "denied",
+				ID:      "42",
+				Nack:    true,
+			},
+			res: "time:11.06.2005 23_59_59.999|method:nack|req:set|name:test|code:PERMISSION_DENY|msg:denied|id:42\n",
+		},
+		`without code`: {
+			inp: Error{
+				Stamp: Time{time.UnixMilli(1118509199999)},
+				Topic: "test",
+			},
+			err: true,
+		},
+	}
+
+	for name, data := range cases {
+		t.Run(name, func(t *testing.T) {
+			res, err := data.inp.Marshal(make([]byte, 0))
+
+			if !data.err {
+				assert.Nil(t, err)
+				assert.Equal(t, data.res, string(res))
+			} else {
+				assert.NotNil(t, err)
+			}
+		})
+	}
+}
+
+func TestErrorUnmarshal(t *testing.T) {
+	cases := map[string]struct {
+		inp string
+		err bool
+		res Error
+	}{
+		`with method`: {
+			inp: "time:11.06.2005 23_59_59.999|method:error|req:set|name:test|code:PERMISSION_DENY|msg:not allowed\\|at all",
+			res: Error{
+				Method:  PUB,
+				Stamp:   Time{time.UnixMilli(1118509199999)},
+				Topic:   "test",
+				Code:    "PERMISSION_DENY",
+				Message: "not allowed|at all",
+			},
+		},
+		`without method`: {
+			inp: "time:11.06.2005 23_59_59.999|method:error|name:none|code:PARAMS_TYPE_ERROR|msg:none",
+			res: Error{
+				Stamp: Time{time.UnixMilli(1118509199999)},
+				Code:  "PARAMS_TYPE_ERROR",
+			},
+		},
+		`with nack`: {
+			inp: "time:11.06.2005 23_59_59.999|method:nack|req:set|name:test|code:PERMISSION_DENY|msg:denied|id:42",
+			res: Error{
+				Method:  PUB,
+				Stamp:   Time{time.UnixMilli(1118509199999)},
+				Topic:   "test",
+				Code:    "PERMISSION_DENY",
+				Message: "denied",
+				ID:      "42",
+				Nack:    true,
+			},
+		},
+		`with regular packet`: {
+			inp: "time:11.06.2005 23_59_59.999|method:set|name:test|val:11.06",
+			err: true,
+		},
+	}
+
+	for name, data := range cases {
+		t.Run(name, func(t *testing.T) {
+			res := Error{}
+			err := res.Unmarshal([]byte(data.inp))
+
+			if !data.err {
+				assert.Nil(t, err)
+				assert.Equal(t, data.res, res)
+			} else {
+				assert.NotNil(t, err)
+			}
+		})
+	}
+}
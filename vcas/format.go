@@ -0,0 +1,104 @@
+package vcas
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+const (
+	// Epoch writes timestamps as milliseconds since the Unix epoch.
+	Epoch = "epoch"
+	// ISO8601 writes timestamps as ISO 8601 with milliseconds and zone
+	// offset, and reads any RFC 3339 timestamp.
+	ISO8601 = "iso8601"
+
+	iso8601 = "2006-01-02T15:04:05.000Z07:00"
+)
+
+// Format describes how timestamps are written on the vcas side. Layout is a
+// time layout, Epoch or ISO8601, and defaults to Stamp. Zone is the zone of
+// timestamps without an offset and defaults to time.Local. A nil Format is
+// valid and uses the defaults.
+type Format struct {
+	Layout string
+	Zone   *time.Location
+}
+
+// NewFormat returns the format for layout and the IANA zone name, where an
+// empty name or "Local" means time.Local.
+func NewFormat(layout, zone string) (*Format, error) {
+	f := &Format{Layout: layout}
+
+	if zone != "" && zone != "Local" {
+		loc, err := time.LoadLocation(zone)
+
+		if err != nil {
+			return nil, fmt.Errorf("zone: %w", err)
+		}
+
+		f.Zone = loc
+	}
+
+	return f, nil
+}
+
+func (f *Format) layout() string {
+	if f == nil || f.Layout == "" {
+		return Stamp
+	}
+
+	return f.Layout
+}
+
+func (f *Format) zone() *time.Location {
+	if f == nil || f.Zone == nil {
+		return time.Local
+	}
+
+	return f.Zone
+}
+
+func (t Time) marshal(buf *bytes.Buffer, f *Format) error {
+	var b [64]byte
+
+	switch l := f.layout(); l {
+	case Epoch:
+		buf.Write(strconv.AppendInt(b[:0], t.UnixMilli(), 10))
+	case ISO8601:
+		buf.Write(t.In(f.zone()).AppendFormat(b[:0], iso8601))
+	default:
+		buf.Write(t.In(f.zone()).AppendFormat(b[:0], l))
+	}
+
+	return nil
+}
+
+func (t *Time) unmarshal(b []byte, f *Format) error {
+	var (
+		tm  time.Time
+		err error
+	)
+
+	switch l := f.layout(); l {
+	case Epoch:
+		var milli int64
+
+		if milli, err = strconv.ParseInt(string(b), 10, 64); err == nil {
+			tm = time.UnixMilli(milli)
+		}
+	case ISO8601:
+		tm, err = time.Parse(time.RFC3339Nano, string(b))
+	default:
+		tm, err = time.ParseInLocation(l, string(b), f.zone())
+	}
+
+	if err != nil {
+		return fmt.Errorf("format: %v", err)
+	}
+
+	t.Time = tm
+
+	return nil
+}
@@ -0,0 +1,118 @@
+package vcas
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFormatMarshal(t *testing.T) {
+	cases := map[string]struct {
+		lay string
+		zon string
+		inp string
+		res string
+	}{
+		`default`:            {inp: "2005-06-11T16:59:59.999Z", res: "11.06.2005 23_59_59.999"},
+		`before dst`:         {zon: "Europe/Berlin", inp: "2023-03-26T00:59:59.999Z", res: "26.03.2023 01_59_59.999"},
+		`after dst`:          {zon: "Europe/Berlin", inp: "2023-03-26T01:00:00Z", res: "26.03.2023 03_00_00.000"},
+		`before std`:         {zon: "Europe/Berlin", inp: "2023-10-29T00:30:00Z", res: "29.10.2023 02_30_00.000"},
+		`after std`:          {zon: "Europe/Berlin", inp: "2023-10-29T01:30:00Z", res: "29.10.2023 02_30_00.000"},
+		`iso8601 before std`: {lay: ISO8601, zon: "Europe/Berlin", inp: "2023-10-29T00:30:00Z", res: "2023-10-29T02:30:00.000+02:00"},
+		`iso8601 after std`:  {lay: ISO8601, zon: "Europe/Berlin", inp: "2023-10-29T01:30:00Z", res: "2023-10-29T02:30:00.000+01:00"},
+		`iso8601 utc`:        {lay: ISO8601, zon: "UTC", inp: "2005-06-11T16:59:59.999Z", res: "2005-06-11T16:59:59.999Z"},
+		`epoch`:              {lay: Epoch, zon: "Europe/Berlin", inp: "2005-06-11T16:59:59.999Z", res: "1118509199999"},
+		`custom layout`:      {lay: "2006/01/02 15:04:05", zon: "America/New_York", inp: "2023-11-05T06:30:00Z", res: "2023/11/05 01:30:00"},
+	}
+
+	for name, data := range cases {
+		t.Run(name, func(t *testing.T) {
+			f, err := NewFormat(data.lay, data.zon)
+			assert.Nil(t, err)
+
+			tm, err := time.Parse(time.RFC3339Nano, data.inp)
+			assert.Nil(t, err)
+
+			buf := &bytes.Buffer{}
+
+			assert.Nil(t, Time{tm}.marshal(buf, f))
+			assert.Equal(t, data.res, buf.String())
+		})
+	}
+}
+
+func TestFormatUnmarshal(t *testing.T) {
+	cases := map[string]struct {
+		lay string
+		zon string
+		inp string
+		err bool
+		res string
+	}{
+		`default`:         {inp: "11.06.2005 23_59_59.999", res: "2005-06-11T16:59:59.999Z"},
+		`before dst`:      {zon: "Europe/Berlin", inp: "26.03.2023 01_59_59.999", res: "2023-03-26T00:59:59.999Z"},
+		`after dst`:       {zon: "Europe/Berlin", inp: "26.03.2023 03_00_00.000", res: "2023-03-26T01:00:00Z"},
+		`summer`:          {zon: "Europe/Berlin", inp: "01.07.2023 12_00_00.000", res: "2023-07-01T10:00:00Z"},
+		`winter`:          {zon: "Europe/Berlin", inp: "01.01.2023 12_00_00.000", res: "2023-01-01T11:00:00Z"},
+		`iso8601 offset`:  {lay: ISO8601, zon: "Europe/Berlin", inp: "2023-10-29T02:30:00.000+01:00", res: "2023-10-29T01:30:00Z"},
+		`iso8601 utc`:     {lay: ISO8601, inp: "2023-10-29T01:30:00Z", res: "2023-10-29T01:30:00Z"},
+		`iso8601 no zone`: {lay: ISO8601, inp: "2023-10-29T01:30:00", err: true},
+		`epoch`:           {lay: Epoch, inp: "1118509199999", res: "2005-06-11T16:59:59.999Z"},
+		`epoch malformed`: {lay: Epoch, inp: "11.06.2005 23_59_59.999", err: true},
+	}
+
+	for name, data := range cases {
+		t.Run(name, func(t *testing.T) {
+			f, err := NewFormat(data.lay, data.zon)
+			assert.Nil(t, err)
+
+			res := Time{}
+			err = res.unmarshal([]byte(data.inp), f)
+
+			if !data.err {
+				exp, _ := time.Parse(time.RFC3339Nano, data.res)
+
+				assert.Nil(t, err)
+				assert.True(t, exp.Equal(res.Time), "%v", res.Time)
+			} else {
+				assert.NotNil(t, err)
+			}
+		})
+	}
+}
+
+// TestFormatRoundTrip walks through both transitions of a year, where every
+// instant must survive layouts carrying the zone offset.
+func TestFormatRoundTrip(t *testing.T) {
+	for _, lay := range []string{ISO8601, Epoch} {
+		f, err := NewFormat(lay, "Europe/Berlin")
+		assert.Nil(t, err)
+
+		for _, beg := range []string{"2023-03-25T22:00:00Z", "2023-10-28T22:00:00Z"} {
+			tm, _ := time.Parse(time.RFC3339, beg)
+
+			for i := 0; i < 24; i++ {
+				inp := Packet{Method: PUB, Topic: "test", Stamp: Time{tm.Add(time.Duration(i) * 15 * time.Minute)}}
+				pay, err := inp.MarshalFormat(nil, f)
+				assert.Nil(t, err)
+
+				res := Packet{}
+				assert.Nil(t, res.UnmarshalFormat(pay, f))
+				assert.True(t, inp.Stamp.Equal(res.Stamp.Time), "%s", pay)
+			}
+		}
+	}
+}
+
+func TestNewFormat(t *testing.T) {
+	f, err := NewFormat("", "")
+
+	assert.Nil(t, err)
+	assert.Equal(t, Stamp, f.layout())
+	assert.Equal(t, time.Local, f.zone())
+
+	_, err = NewFormat("", "Mars/Olympus")
+	assert.NotNil(t, err)
+}
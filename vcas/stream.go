@@ -0,0 +1,143 @@
+package vcas
+
+import (
+	"bytes"
+	"errors"
+	"io"
+)
+
+const (
+	MaxLen = 1 << 20
+)
+
+var (
+	ErrTooLong = errors.New("line too long")
+)
+
+type Decoder struct {
+	r    io.Reader
+	buf  []byte
+	beg  int
+	max  int
+	err  error
+	skip bool
+	fmt  *Format
+}
+
+func NewDecoder(r io.Reader) *Decoder {
+	return &Decoder{
+		r:   r,
+		buf: make([]byte, 0, 0xff),
+		max: MaxLen,
+	}
+}
+
+func (dec *Decoder) SetMaxLen(n int) {
+	dec.max = n
+}
+
+// Reset drops buffered input, including a partial line and a pending read
+// error.
+func (dec *Decoder) Reset() {
+	dec.buf = dec.buf[:0]
+	dec.beg = 0
+	dec.err = nil
+	dec.skip = false
+}
+
+// SetFormat sets the timestamp format of the decoded lines.
+func (dec *Decoder) SetFormat(f *Format) {
+	dec.fmt = f
+}
+
+// Decode reads the next non-empty line from the underlying reader and
+// unmarshals it into pkt. A trailing partial line is kept until the rest of
+// it arrives, so Decode may be called again after io.EOF once the reader has
+// more data. Lines longer than the limit are discarded with ErrTooLong.
+func (dec *Decoder) Decode(pkt *Packet) error {
+	for {
+		if i := bytes.IndexByte(dec.buf[dec.beg:], '\n'); i >= 0 {
+			line := dec.buf[dec.beg : dec.beg+i]
+			dec.beg += i + 1
+
+			if dec.skip {
+				dec.skip = false
+				continue
+			}
+
+			if len(line) > dec.max {
+				return ErrTooLong
+			}
+
+			line = bytes.TrimSuffix(line, []byte{'\r'})
+
+			if len(bytes.TrimSpace(line)) == 0 {
+				continue
+			}
+
+			return pkt.UnmarshalFormat(line, dec.fmt)
+		}
+
+		if len(dec.buf)-dec.beg > dec.max {
+			dec.buf = dec.buf[:0]
+			dec.beg = 0
+
+			if !dec.skip {
+				dec.skip = true
+				return ErrTooLong
+			}
+		}
+
+		if err := dec.err; err != nil {
+			dec.err = nil
+			return err
+		}
+
+		if dec.beg > 0 {
+			dec.buf = dec.buf[:copy(dec.buf, dec.buf[dec.beg:])]
+			dec.beg = 0
+		}
+
+		if len(dec.buf) == cap(dec.buf) {
+			dec.buf = append(dec.buf, 0)[:len(dec.buf)]
+		}
+
+		n, err := dec.r.Read(dec.buf[len(dec.buf):cap(dec.buf)])
+		dec.buf = dec.buf[:len(dec.buf)+n]
+		dec.err = err
+	}
+}
+
+type Encoder struct {
+	w   io.Writer
+	buf []byte
+	fmt *Format
+}
+
+func NewEncoder(w io.Writer) *Encoder {
+	return &Encoder{
+		w:   w,
+		buf: make([]byte, 0, 0xff),
+	}
+}
+
+// SetFormat sets the timestamp format of the encoded lines.
+func (enc *Encoder) SetFormat(f *Format) {
+	enc.fmt = f
+}
+
+func (enc *Encoder) Encode(pkt *Packet) error {
+	buf, err := pkt.MarshalFormat(enc.buf[:0], enc.fmt)
+
+	if err != nil {
+		return err
+	}
+
+	enc.buf = buf
+
+	if _, err := enc.w.Write(buf); err != nil {
+		return err
+	}
+
+	return nil
+}
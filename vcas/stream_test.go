@@ -0,0 +1,146 @@
+package vcas
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+	"testing/iotest"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDecode(t *testing.T) {
+	cases := map[string]struct {
+		inp string
+		max int
+		exp []Packet
+		err []bool
+	}{
+		`single`: {
+			inp: "name:test|method:set|val:11.06\n",
+			exp: []Packet{{Method: PUB, Topic: "test", Value: "11.06"}},
+			err: []bool{false},
+		},
+		`multiple`: {
+			inp: "name:a|method:set|val:1\nname:b|method:get\n",
+			exp: []Packet{
+				{Method: PUB, Topic: "a", Value: "1"},
+				{Method: GET, Topic: "b"},
+			},
+			err: []bool{false, false},
+		},
+		`with crlf`: {
+			inp: "name:test|method:set|val:11.06\r\n",
+			exp: []Packet{{Method: PUB, Topic: "test", Value: "11.06"}},
+			err: []bool{false},
+		},
+		`with empty lines`: {
+			inp: "\n\r\n \nname:test|method:set|val:11.06\n",
+			exp: []Packet{{Method: PUB, Topic: "test", Value: "11.06"}},
+			err: []bool{false},
+		},
+		`with partial line`: {
+			inp: "name:a|method:set|val:1\nname:b|meth",
+			exp: []Packet{{Method: PUB, Topic: "a", Value: "1"}},
+			err: []bool{false},
+		},
+		`with long line`: {
+			inp: "name:a|method:set|val:1234567890\nname:b|method:set|val:1\n",
+			max: 24,
+			exp: []Packet{{}, {Method: PUB, Topic: "b", Value: "1"}},
+			err: []bool{true, false},
+		},
+		`with malformed line`: {
+			inp: "name:a|method:extra\nname:b|method:set|val:1\n",
+			exp: []Packet{{}, {Method: PUB, Topic: "b", Value: "1"}},
+			err: []bool{true, false},
+		},
+	}
+
+	for name, data := range cases {
+		t.Run(name, func(t *testing.T) {
+			dec := NewDecoder(iotest.OneByteReader(strings.NewReader(data.inp)))
+
+			if data.max > 0 {
+				dec.SetMaxLen(data.max)
+			}
+
+			for i := range data.exp {
+				pkt := Packet{}
+				err := dec.Decode(&pkt)
+
+				if data.err[i] {
+					assert.NotNil(t, err)
+					continue
+				}
+
+				assert.Nil(t, err)
+				assert.Equal(t, data.exp[i], pkt)
+			}
+
+			assert.ErrorIs(t, dec.Decode(&Packet{}), io.EOF)
+		})
+	}
+}
+
+func TestDecodeTooLong(t *testing.T) {
+	dec := NewDecoder(strings.NewReader("name:a|method:set|val:1234567890\nname:b|method:set|val:1\n"))
+	dec.SetMaxLen(24)
+
+	assert.ErrorIs(t, dec.Decode(&Packet{}), ErrTooLong)
+	assert.Nil(t, dec.Decode(&Packet{}))
+}
+
+func TestDecodeResume(t *testing.T) {
+	buf := &bytes.Buffer{}
+	dec := NewDecoder(buf)
+	pkt := Packet{}
+
+	buf.WriteString("name:test|meth")
+	assert.ErrorIs(t, dec.Decode(&pkt), io.EOF)
+
+	buf.WriteString("od:set|val:11.06\n")
+	assert.Nil(t, dec.Decode(&pkt))
+	assert.Equal(t, Packet{Method: PUB, Topic: "test", Value: "11.06"}, pkt)
+}
+
+func TestDecodeReset(t *testing.T) {
+	buf := &bytes.Buffer{}
+	dec := NewDecoder(buf)
+	pkt := Packet{}
+
+	buf.WriteString("name:test|meth")
+	assert.ErrorIs(t, dec.Decode(&pkt), io.EOF)
+
+	dec.Reset()
+
+	buf.WriteString("name:test|method:set|val:11.06\n")
+	assert.Nil(t, dec.Decode(&pkt))
+	assert.Equal(t, Packet{Method: PUB, Topic: "test", Value: "11.06"}, pkt)
+}
+
+func TestEncode(t *testing.T) {
+	buf := &bytes.Buffer{}
+	enc := NewEncoder(buf)
+
+	for _, v := range []string{"1", "2"} {
+		err := enc.Encode(&Packet{
+			Method: PUB,
+			Topic:  "test",
+			Stamp:  Time{time.UnixMilli(1118509199999)},
+			Value:  v,
+		})
+
+		assert.Nil(t, err)
+	}
+
+	assert.Equal(t, ""+
+		"time:11.06.2005 23_59_59.999|method:set|name:test|val:1|descr:none|type:rw|units:none\n"+
+		"time:11.06.2005 23_59_59.999|method:set|name:test|val:2|descr:none|type:rw|units:none\n",
+		buf.String(),
+	)
+
+	assert.NotNil(t, enc.Encode(&Packet{Method: PUB}))
+}
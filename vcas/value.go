@@ -0,0 +1,469 @@
+package vcas
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// Kind is the type of a packet value. Auto values are inferred from their
+// textual form.
+type Kind int
+
+const (
+	Auto Kind = iota
+	String
+	Int
+	Float
+	Bool
+	Array
+
+	ArraySep = ','
+)
+
+func (k Kind) String() string {
+	switch k {
+	case Auto:
+		return "auto"
+	case String:
+		return "string"
+	case Int:
+		return "int"
+	case Float:
+		return "float"
+	case Bool:
+		return "bool"
+	case Array:
+		return "array"
+	default:
+		return fmt.Sprintf("kind(%d)", int(k))
+	}
+}
+
+func (k *Kind) unmarshal(b []byte) error {
+	s := string(b)
+
+	switch s {
+	case "auto", "none":
+		*k = Auto
+	case "s", "str", "string":
+		*k = String
+	case "i", "int", "long":
+		*k = Int
+	case "f", "float", "double":
+		*k = Float
+	case "b", "bool":
+		*k = Bool
+	case "a", "array":
+		*k = Array
+	default:
+		return fmt.Errorf("unknown: %v", s)
+	}
+
+	return nil
+}
+
+// infer returns the narrowest kind the textual value v can be read as. Only
+// numbers already in JSON form are inferred, so that values such as zero
+// padded serials keep their text.
+func infer(v string) Kind {
+	if number(v) {
+		if _, err := strconv.ParseInt(v, 10, 64); err == nil {
+			return Int
+		}
+
+		return Float
+	}
+
+	if v == "true" || v == "false" {
+		return Bool
+	}
+
+	return String
+}
+
+// Resolve replaces Auto with the inferred kind and checks that the value
+// matches an explicit one. A mismatch is an error in strict mode, otherwise
+// the value falls back to String. Arrays are never inferred.
+func (pkt *Packet) Resolve(strict bool) error {
+	if pkt.Value == "" {
+		return nil
+	}
+
+	ok := true
+
+	switch pkt.Kind {
+	case Auto:
+		pkt.Kind = infer(pkt.Value)
+	case Int:
+		_, err := strconv.ParseInt(pkt.Value, 10, 64)
+		ok = err == nil
+	case Float:
+		f, err := strconv.ParseFloat(pkt.Value, 64)
+		ok = err == nil && !math.IsInf(f, 0) && !math.IsNaN(f)
+	case Bool:
+		_, err := strconv.ParseBool(pkt.Value)
+		ok = err == nil
+	case Array:
+		ok = pkt.Len == 0 || pkt.Len == count(pkt.Value)
+	}
+
+	if !ok {
+		if strict {
+			return fmt.Errorf("value: not %v: %v", pkt.Kind, pkt.Value)
+		}
+
+		pkt.Kind = String
+	}
+
+	return nil
+}
+
+// count returns the number of elements in the array value v.
+func count(v string) int {
+	if v == "" {
+		return 0
+	}
+
+	n := 1
+
+	for i := 0; i < len(v); i++ {
+		switch v[i] {
+		case EscapeCh:
+			i++
+		case ArraySep:
+			n++
+		}
+	}
+
+	return n
+}
+
+// next splits the first element off the array value v. The last result is
+// false when v holds a single element.
+func next(v string) (string, string, bool) {
+	for i := 0; i < len(v); i++ {
+		switch v[i] {
+		case EscapeCh:
+			i++
+		case ArraySep:
+			return v[:i], v[i+1:], true
+		}
+	}
+
+	return v, "", false
+}
+
+// element unescapes a single array element. Elements are escaped once, as
+// the rest of the line is, with ArraySep escaped as well.
+func element(e string) string {
+	if strings.IndexByte(e, EscapeCh) < 0 {
+		return e
+	}
+
+	var buf strings.Builder
+
+	for i := 0; i < len(e); i++ {
+		if e[i] != EscapeCh || i+1 == len(e) {
+			buf.WriteByte(e[i])
+			continue
+		}
+
+		switch c := e[i+1]; c {
+		case EscapeCh, OuterSep, InnerSep, ArraySep:
+			buf.WriteByte(c)
+		case 'n':
+			buf.WriteByte('\n')
+		case 'r':
+			buf.WriteByte('\r')
+		case 't':
+			buf.WriteByte('\t')
+		default:
+			buf.WriteByte(EscapeCh)
+			buf.WriteByte(c)
+		}
+
+		i++
+	}
+
+	return buf.String()
+}
+
+// escapeElement reverses element.
+func escapeElement(buf *strings.Builder, e string) {
+	for i := 0; i < len(e); i++ {
+		switch c := e[i]; c {
+		case EscapeCh, OuterSep, ArraySep:
+			buf.WriteByte(EscapeCh)
+			buf.WriteByte(c)
+		case '\n':
+			buf.WriteString("\\n")
+		case '\r':
+			buf.WriteString("\\r")
+		case '\t':
+			buf.WriteString("\\t")
+		default:
+			buf.WriteByte(c)
+		}
+	}
+}
+
+// escapeArray writes the array value v, whose elements are already
+// escaped, to the line. Only what would break the framing is escaped.
+func escapeArray(buf *bytes.Buffer, v string) {
+	for i := 0; i < len(v); i++ {
+		switch c := v[i]; c {
+		case EscapeCh:
+			if i+1 == len(v) {
+				buf.WriteString("\\\\")
+				continue
+			}
+
+			buf.WriteByte(c)
+			i++
+			buf.WriteByte(v[i])
+		case '\n', '\r', '\t', OuterSep:
+			escape(buf, v[i:i+1])
+		default:
+			buf.WriteByte(c)
+		}
+	}
+}
+
+// appendValue appends the JSON form of the value, falling back to a JSON
+// string whenever the value does not match its kind. Array elements are
+// inferred one by one and empty ones become null.
+func (pkt *Packet) appendValue(b []byte) []byte {
+	if pkt.Kind != Array {
+		return appendScalar(b, pkt.Value, pkt.Kind)
+	}
+
+	b = append(b, '[')
+
+	for v, more := pkt.Value, true; more; {
+		var e string
+
+		e, v, more = next(v)
+
+		switch {
+		case e == "":
+			b = append(b, "null"...)
+		case number(e):
+			b = append(b, e...)
+		case strings.IndexByte(e, EscapeCh) >= 0:
+			b = appendScalar(b, element(e), String)
+		default:
+			b = appendScalar(b, e, Auto)
+		}
+
+		if more {
+			b = append(b, ',')
+		}
+	}
+
+	return append(b, ']')
+}
+
+// number reports whether v is a finite number already in JSON form, so that
+// it can be inferred as one and copied without reformatting.
+func number(v string) bool {
+	i := 0
+
+	if i < len(v) && v[i] == '-' {
+		i++
+	}
+
+	digits := func() bool {
+		j := i
+
+		for i < len(v) && v[i] >= '0' && v[i] <= '9' {
+			i++
+		}
+
+		return i > j
+	}
+
+	switch {
+	case i < len(v) && v[i] == '0':
+		i++
+	case !digits():
+		return false
+	}
+
+	if i < len(v) && v[i] == '.' {
+		i++
+
+		if !digits() {
+			return false
+		}
+	}
+
+	if i < len(v) && (v[i] == 'e' || v[i] == 'E') {
+		i++
+
+		if i < len(v) && (v[i] == '+' || v[i] == '-') {
+			i++
+		}
+
+		if !digits() {
+			return false
+		}
+	}
+
+	if i != len(v) {
+		return false
+	}
+
+	f, err := strconv.ParseFloat(v, 64)
+
+	return err == nil && !math.IsInf(f, 0)
+}
+
+func appendScalar(b []byte, v string, k Kind) []byte {
+	if k == Auto {
+		k = infer(v)
+	}
+
+	switch k {
+	case Int:
+		if i, err := strconv.ParseInt(v, 10, 64); err == nil {
+			return strconv.AppendInt(b, i, 10)
+		}
+	case Float:
+		if f, err := strconv.ParseFloat(v, 64); err == nil && !math.IsInf(f, 0) && !math.IsNaN(f) {
+			return strconv.AppendFloat(b, f, 'g', -1, 64)
+		}
+	case Bool:
+		if x, err := strconv.ParseBool(v); err == nil {
+			return strconv.AppendBool(b, x)
+		}
+	}
+
+	res, _ := json.Marshal(v)
+
+	return append(b, res...)
+}
+
+// unmarshalValue reads a JSON value into its textual form and kind.
+func (pkt *Packet) unmarshalValue(raw json.RawMessage) error {
+	raw = bytes.TrimSpace(raw)
+	pkt.Len = 0
+
+	switch {
+	case len(raw) == 0 || string(raw) == "null":
+		pkt.Value, pkt.Kind = "", Auto
+	case raw[0] == '[':
+		v, n, err := unmarshalArray(raw)
+
+		if err != nil {
+			return err
+		}
+
+		pkt.Value, pkt.Kind, pkt.Len = v, Array, n
+	default:
+		v, k, err := unmarshalScalar(raw)
+
+		if err != nil {
+			return err
+		}
+
+		pkt.Value, pkt.Kind = v, k
+	}
+
+	return nil
+}
+
+func unmarshalScalar(raw json.RawMessage) (string, Kind, error) {
+	switch {
+	case string(raw) == "null":
+		return "", String, nil
+	case raw[0] == '"':
+		var s string
+
+		if err := json.Unmarshal(raw, &s); err != nil {
+			return "", Auto, err
+		}
+
+		return s, String, nil
+	case string(raw) == "true" || string(raw) == "false":
+		return string(raw), Bool, nil
+	default:
+		var num json.Number
+
+		if err := json.Unmarshal(raw, &num); err != nil {
+			return "", Auto, err
+		}
+
+		if _, err := num.Int64(); err == nil {
+			return num.String(), Int, nil
+		}
+
+		return num.String(), Float, nil
+	}
+}
+
+// unmarshalArray reads a JSON array of scalars into its textual form and
+// length. Arrays of numbers and booleans are copied without decoding.
+func unmarshalArray(raw json.RawMessage) (string, int, error) {
+	in := bytes.TrimSpace(raw[1 : len(raw)-1])
+
+	if len(in) == 0 {
+		return "", 0, nil
+	}
+
+	if bytes.IndexAny(in, "\"[{n") < 0 {
+		var buf strings.Builder
+
+		buf.Grow(len(in))
+
+		for _, c := range in {
+			switch c {
+			case ' ', '\t', '\r', '\n':
+			default:
+				buf.WriteByte(c)
+			}
+		}
+
+		v := buf.String()
+
+		return v, count(v), nil
+	}
+
+	var els []json.RawMessage
+
+	if err := json.Unmarshal(raw, &els); err != nil {
+		return "", 0, err
+	}
+
+	var buf strings.Builder
+
+	for i, el := range els {
+		if i > 0 {
+			buf.WriteByte(ArraySep)
+		}
+
+		el = bytes.TrimSpace(el)
+
+		if len(el) > 0 && (el[0] == '[' || el[0] == '{') {
+			return "", 0, fmt.Errorf("array: nested values")
+		}
+
+		v, k, err := unmarshalScalar(el)
+
+		if err != nil {
+			return "", 0, err
+		}
+
+		if k != String {
+			buf.WriteString(v)
+			continue
+		}
+
+		escapeElement(&buf, v)
+	}
+
+	return buf.String(), len(els), nil
+}
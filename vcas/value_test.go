@@ -0,0 +1,268 @@
+package vcas
+
+import (
+	"encoding/json"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestResolve(t *testing.T) {
+	cases := map[string]struct {
+		val    string
+		kind   Kind
+		len    int
+		strict bool
+		err    bool
+		res    Kind
+	}{
+		`auto int`:              {val: "42", res: Int},
+		`auto float`:            {val: "11.06", res: Float},
+		`auto exponent`:         {val: "1e-3", res: Float},
+		`auto bool`:             {val: "true", res: Bool},
+		`auto string`:           {val: "on", res: String},
+		`auto infinity`:         {val: "Inf", res: String},
+		`auto leading zeros`:    {val: "007", res: String},
+		`auto negative zeros`:   {val: "-007", res: String},
+		`auto hex`:              {val: "0x1p4", res: String},
+		`auto underscores`:      {val: "1_000", res: String},
+		`auto plus`:             {val: "+1", res: String},
+		`auto zero`:             {val: "0", res: Int},
+		`auto zero fraction`:    {val: "0.5", res: Float},
+		`auto big int`:          {val: "18446744073709551616", res: Float},
+		`explicit float zeros`:  {val: "007", kind: Float, res: Float},
+		`explicit string`:       {val: "42", kind: String, res: String},
+		`explicit float`:        {val: "42", kind: Float, res: Float},
+		`explicit bool`:         {val: "1", kind: Bool, res: Bool},
+		`lenient mismatch`:      {val: "11.06", kind: Int, res: String},
+		`strict mismatch`:       {val: "11.06", kind: Int, strict: true, err: true},
+		`strict bool mismatch`:  {val: "yes", kind: Bool, strict: true, err: true},
+		`strict float mismatch`: {val: "NaN", kind: Float, strict: true, err: true},
+		`auto array`:            {val: "1,2", res: String},
+		`array`:                 {val: "1,2", kind: Array, res: Array},
+		`array with len`:        {val: "1,2", kind: Array, len: 2, res: Array},
+		`lenient len mismatch`:  {val: "1,2", kind: Array, len: 3, res: String},
+		`strict len mismatch`:   {val: "1,2", kind: Array, len: 3, strict: true, err: true},
+	}
+
+	for name, data := range cases {
+		t.Run(name, func(t *testing.T) {
+			pkt := Packet{Value: data.val, Kind: data.kind, Len: data.len}
+			err := pkt.Resolve(data.strict)
+
+			if !data.err {
+				assert.Nil(t, err)
+				assert.Equal(t, data.res, pkt.Kind)
+			} else {
+				assert.NotNil(t, err)
+			}
+		})
+	}
+}
+
+func TestMarshalJSON(t *testing.T) {
+	cases := map[string]struct {
+		inp Packet
+		res string
+	}{
+		`int`: {
+			inp: Packet{Value: "42", Kind: Int},
+			res: `{"timestamp":1118509199999,"value":42}`,
+		},
+		`float`: {
+			inp: Packet{Value: "11.060", Kind: Float},
+			res: `{"timestamp":1118509199999,"value":11.06}`,
+		},
+		`bool`: {
+			inp: Packet{Value: "1", Kind: Bool},
+			res: `{"timestamp":1118509199999,"value":true}`,
+		},
+		`string`: {
+			inp: Packet{Value: "11.06", Kind: String},
+			res: `{"timestamp":1118509199999,"value":"11.06"}`,
+		},
+		`auto`: {
+			inp: Packet{Value: "11.06", Units: "mA"},
+			res: `{"timestamp":1118509199999,"value":11.06,"units":"mA"}`,
+		},
+		`auto leading zeros`: {
+			inp: Packet{Value: "007"},
+			res: `{"timestamp":1118509199999,"value":"007"}`,
+		},
+		`auto hex`: {
+			inp: Packet{Value: "0x1p4"},
+			res: `{"timestamp":1118509199999,"value":"0x1p4"}`,
+		},
+		`mismatch`: {
+			inp: Packet{Value: "on", Kind: Float},
+			res: `{"timestamp":1118509199999,"value":"on"}`,
+		},
+		`array`: {
+			inp: Packet{Value: "1.5,2,on,,a\\,b\\\\", Kind: Array},
+			res: `{"timestamp":1118509199999,"value":[1.5,2,"on",null,"a,b\\"]}`,
+		},
+		`alarm`: {
+			inp: Packet{Value: "11.06", Severity: Invalid, Status: "UDF"},
+			res: `{"timestamp":1118509199999,"value":11.06,"severity":"INVALID","status":"UDF"}`,
+		},
+		`empty`: {
+			inp: Packet{Kind: Float},
+			res: `{"timestamp":1118509199999}`,
+		},
+	}
+
+	for name, data := range cases {
+		t.Run(name, func(t *testing.T) {
+			data.inp.Stamp = Time{time.UnixMilli(1118509199999)}
+			res, err := json.Marshal(&data.inp)
+
+			assert.Nil(t, err)
+			assert.Equal(t, data.res, string(res))
+		})
+	}
+}
+
+func TestUnmarshalJSON(t *testing.T) {
+	cases := map[string]struct {
+		inp string
+		err bool
+		res Packet
+	}{
+		`int`: {
+			inp: `{"timestamp":1118509199999,"value":42}`,
+			res: Packet{Value: "42", Kind: Int},
+		},
+		`float`: {
+			inp: `{"timestamp":1118509199999,"value":11.06}`,
+			res: Packet{Value: "11.06", Kind: Float},
+		},
+		`bool`: {
+			inp: `{"timestamp":1118509199999,"value":false}`,
+			res: Packet{Value: "false", Kind: Bool},
+		},
+		`string`: {
+			inp: `{"timestamp":1118509199999,"value":"11.06","units":"mA"}`,
+			res: Packet{Value: "11.06", Kind: String, Units: "mA"},
+		},
+		`null`: {
+			inp: `{"timestamp":1118509199999,"value":null}`,
+			res: Packet{},
+		},
+		`array`: {
+			inp: `{"timestamp":1118509199999,"value":[1.5, 2, -3e2]}`,
+			res: Packet{Value: "1.5,2,-3e2", Kind: Array, Len: 3},
+		},
+		`array with strings`: {
+			inp: `{"timestamp":1118509199999,"value":[1.5,"on",null,"a,b\\",true]}`,
+			res: Packet{Value: "1.5,on,,a\\,b\\\\,true", Kind: Array, Len: 5},
+		},
+		`empty array`: {
+			inp: `{"timestamp":1118509199999,"value":[]}`,
+			res: Packet{Kind: Array},
+		},
+		`nested array`: {
+			inp: `{"timestamp":1118509199999,"value":[[1],[2]]}`,
+			err: true,
+		},
+		`alarm`: {
+			inp: `{"timestamp":1118509199999,"value":11.06,"severity":"MAJOR","status":"HIHI"}`,
+			res: Packet{Value: "11.06", Kind: Float, Severity: Major, Status: "HIHI"},
+		},
+		`unknown severity`: {
+			inp: `{"timestamp":1118509199999,"value":11.06,"severity":"HIHI"}`,
+			err: true,
+		},
+		`object`: {
+			inp: `{"timestamp":1118509199999,"value":{}}`,
+			err: true,
+		},
+	}
+
+	for name, data := range cases {
+		t.Run(name, func(t *testing.T) {
+			pkt := Packet{}
+			err := json.Unmarshal([]byte(data.inp), &pkt)
+
+			if !data.err {
+				data.res.Stamp = Time{time.UnixMilli(1118509199999)}
+
+				assert.Nil(t, err)
+				assert.Equal(t, data.res, pkt)
+			} else {
+				assert.NotNil(t, err)
+			}
+		})
+	}
+}
+
+func TestArrayRoundTrip(t *testing.T) {
+	cases := map[string]struct {
+		val string
+		res string
+	}{
+		`plain`: {
+			val: `1.5,2,on`,
+			res: `[1.5,2,"on"]`,
+		},
+		`escaped separator`: {
+			val: `a\,b,c`,
+			res: `["a,b","c"]`,
+		},
+		`escaped backslash`: {
+			val: `C:\\dir,x`,
+			res: `["C:\\dir","x"]`,
+		},
+		`backslash before separator`: {
+			val: `a\\,b`,
+			res: `["a\\","b"]`,
+		},
+		`escaped framing`: {
+			val: `a\|b,c\nd,`,
+			res: `["a|b","c\nd",null]`,
+		},
+	}
+
+	for name, data := range cases {
+		t.Run(name, func(t *testing.T) {
+			inp := "time:11.06.2005 23_59_59.999|method:set|name:test|val:" + data.val +
+				"|descr:none|type:rw|units:none|kind:array|len:" + strconv.Itoa(count(data.val)) + "\n"
+
+			pkt := Packet{}
+			assert.Nil(t, pkt.Unmarshal([]byte(inp)))
+
+			pay, err := json.Marshal(&pkt)
+			assert.Nil(t, err)
+			assert.Equal(t, `{"timestamp":1118509199999,"value":`+data.res+`,"type":"rw"}`, string(pay))
+
+			res := Packet{Method: pkt.Method, Topic: pkt.Topic}
+			assert.Nil(t, json.Unmarshal(pay, &res))
+
+			out, err := res.Marshal(nil)
+			assert.Nil(t, err)
+			assert.Equal(t, inp, string(out))
+		})
+	}
+}
+
+func BenchmarkMarshalJSONArray(b *testing.B) {
+	pkt := Packet{Value: waveform(4096), Kind: Array}
+
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		json.Marshal(&pkt)
+	}
+}
+
+func BenchmarkUnmarshalJSONArray(b *testing.B) {
+	pay, _ := json.Marshal(&Packet{Value: waveform(4096), Kind: Array})
+
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		pkt := Packet{}
+		json.Unmarshal(pay, &pkt)
+	}
+}
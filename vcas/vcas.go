@@ -2,6 +2,7 @@ package vcas
 
 import (
 	"bytes"
+	"encoding/json"
 	"fmt"
 	"strconv"
 	"time"
@@ -17,27 +18,58 @@ const (
 	SUB
 	USB
 	GET
+	PING
+	LOGIN
+	ERR
+	ACK
+	NACK
+	PSUB
+	PUSB
 
 	OuterSep = '|'
 	InnerSep = ':'
+	EscapeCh = '\\'
 )
 
 type Method int
 
-func (m Method) marshal(buf *bytes.Buffer) error {
+// String returns the name the method is written with.
+func (m Method) String() string {
 	switch m {
 	case PUB:
-		buf.WriteString("set")
+		return "set"
 	case SUB:
-		buf.WriteString("subscribe")
+		return "subscribe"
 	case USB:
-		buf.WriteString("release")
+		return "release"
 	case GET:
-		buf.WriteString("get")
+		return "get"
+	case PING:
+		return "ping"
+	case LOGIN:
+		return "login"
+	case ERR:
+		return "error"
+	case ACK:
+		return "ack"
+	case NACK:
+		return "nack"
+	case PSUB:
+		return "psubscribe"
+	case PUSB:
+		return "prelease"
 	default:
-		return fmt.Errorf("unknown: %v", m)
+		return fmt.Sprintf("method(%d)", int(m))
+	}
+}
+
+func (m Method) marshal(buf *bytes.Buffer) error {
+	if m < PUB || m > PUSB {
+		return fmt.Errorf("unknown: %d", int(m))
 	}
 
+	buf.WriteString(m.String())
+
 	return nil
 }
 
@@ -53,6 +85,20 @@ func (m *Method) unmarshal(b []byte) error {
 		*m = USB
 	case "g", "gf", "get", "getfull":
 		*m = GET
+	case "p", "ping":
+		*m = PING
+	case "login":
+		*m = LOGIN
+	case "error":
+		*m = ERR
+	case "ack":
+		*m = ACK
+	case "nack":
+		*m = NACK
+	case "psb", "psubscr", "psubscribe":
+		*m = PSUB
+	case "prel", "prelease":
+		*m = PUSB
 	default:
 		return fmt.Errorf("unknown: %v", s)
 	}
@@ -64,62 +110,104 @@ type Time struct {
 	time.Time
 }
 
-func (t Time) marshal(buf *bytes.Buffer) error {
-	buf.WriteString(t.Format(Stamp))
-
-	return nil
+func (t Time) MarshalJSON() ([]byte, error) {
+	return []byte(strconv.FormatInt(t.UnixMilli(), 10)), nil
 }
 
-func (t *Time) unmarshal(b []byte) error {
-	tm, err := time.ParseInLocation(Stamp, string(b), time.Local)
+func (t *Time) UnmarshalJSON(json []byte) error {
+	milli, err := strconv.ParseInt(string(json), 10, 64)
 
 	if err != nil {
-		return fmt.Errorf("format: %v", err)
+		return fmt.Errorf("format: %w", err)
 	}
 
-	t.Time = tm
+	t.Time = time.UnixMilli(milli)
 
 	return nil
 }
 
-func (t Time) MarshalJSON() ([]byte, error) {
-	return []byte(strconv.FormatInt(t.UnixMilli(), 10)), nil
+type Packet struct {
+	Method   Method
+	Stamp    Time
+	Topic    string
+	Value    string
+	Kind     Kind
+	Len      int
+	Descr    string
+	Type     string
+	Units    string
+	Severity Severity
+	Status   string
+	User     string
+	Pass     string
+	ID       string
 }
 
-func (t *Time) UnmarshalJSON(json []byte) error {
-	milli, err := strconv.ParseInt(string(json), 10, 64)
+// payload is the JSON form of a packet published to EMQX.
+type payload struct {
+	Stamp Time            `json:"timestamp"`
+	Value json.RawMessage `json:"value,omitempty"`
+	Descr string          `json:"description,omitempty"`
+	Type  string          `json:"type,omitempty"`
+	Units string          `json:"units,omitempty"`
+	Sev   Severity        `json:"severity,omitempty"`
+	Stat  string          `json:"status,omitempty"`
+}
 
-	if err != nil {
-		return fmt.Errorf("format: %w", err)
+func (pkt *Packet) MarshalJSON() ([]byte, error) {
+	pay := payload{
+		Stamp: pkt.Stamp,
+		Descr: pkt.Descr,
+		Type:  pkt.Type,
+		Units: pkt.Units,
+		Sev:   pkt.Severity,
+		Stat:  pkt.Status,
 	}
 
-	t.Time = time.UnixMilli(milli)
+	if pkt.Value != "" {
+		pay.Value = pkt.appendValue(nil)
+	}
 
-	return nil
+	return json.Marshal(&pay)
 }
 
-type Packet struct {
-	Method Method `json:"-"`
-	Stamp  Time   `json:"timestamp"`
-	Topic  string `json:"-"`
-	Value  string `json:"value,omitempty"`
+func (pkt *Packet) UnmarshalJSON(b []byte) error {
+	pay := payload{Stamp: pkt.Stamp}
+
+	if err := json.Unmarshal(b, &pay); err != nil {
+		return err
+	}
+
+	if err := pkt.unmarshalValue(pay.Value); err != nil {
+		return fmt.Errorf("value: %w", err)
+	}
+
+	pkt.Stamp = pay.Stamp
+	pkt.Descr = pay.Descr
+	pkt.Type = pay.Type
+	pkt.Units = pay.Units
+	pkt.Severity = pay.Sev
+	pkt.Status = pay.Stat
+
+	return nil
 }
 
 func (pkt *Packet) Marshal(pay []byte) ([]byte, error) {
+	return pkt.MarshalFormat(pay, nil)
+}
+
+// MarshalFormat is like Marshal but writes the timestamp in format f.
+func (pkt *Packet) MarshalFormat(pay []byte, f *Format) ([]byte, error) {
 	if pkt.Topic == "" {
 		return nil, fmt.Errorf("topic: not found")
 	}
 
-	if pkt.Value == "" {
-		pkt.Value = "none"
-	}
-
 	buf := bytes.NewBuffer(pay)
 
-	buf.Grow(63 + len(pkt.Topic) + len(pkt.Value))
+	buf.Grow(63 + len(pkt.Topic) + len(pkt.Value) + len(pkt.Descr) + len(pkt.Units))
 	buf.WriteString("time:")
 
-	if err := pkt.Stamp.marshal(buf); err != nil {
+	if err := pkt.Stamp.marshal(buf, f); err != nil {
 		return nil, fmt.Errorf("time: %w", err)
 	}
 
@@ -130,44 +218,272 @@ func (pkt *Packet) Marshal(pay []byte) ([]byte, error) {
 	}
 
 	buf.WriteString("|name:")
-	buf.WriteString(pkt.Topic)
+	escape(buf, pkt.Topic)
 	buf.WriteString("|val:")
-	buf.WriteString(pkt.Value)
-	buf.WriteString("|descr:none|type:rw|units:none\n")
+
+	if pkt.Kind == Array {
+		escapeArray(buf, orDefault(pkt.Value, "none"))
+	} else {
+		escape(buf, orDefault(pkt.Value, "none"))
+	}
+
+	buf.WriteString("|descr:")
+	escape(buf, orDefault(pkt.Descr, "none"))
+	buf.WriteString("|type:")
+	escape(buf, orDefault(pkt.Type, "rw"))
+	buf.WriteString("|units:")
+	escape(buf, orDefault(pkt.Units, "none"))
+
+	if pkt.Severity != 0 {
+		b, err := pkt.Severity.MarshalText()
+
+		if err != nil {
+			return nil, fmt.Errorf("severity: %w", err)
+		}
+
+		buf.WriteString("|severity:")
+		buf.Write(b)
+	}
+
+	if pkt.Status != "" {
+		buf.WriteString("|status:")
+		escape(buf, pkt.Status)
+	}
+
+	if pkt.Kind == Array {
+		buf.WriteString("|kind:array|len:")
+		buf.WriteString(strconv.Itoa(count(pkt.Value)))
+	}
+
+	if pkt.ID != "" {
+		buf.WriteString("|id:")
+		escape(buf, pkt.ID)
+	}
+
+	buf.WriteByte('\n')
 
 	return buf.Bytes(), nil
 }
 
+// Unmarshal parses pay into pkt. Tokens following a malformed one are still
+// parsed so that the caller can tell which channel the line was about.
 func (pkt *Packet) Unmarshal(pay []byte) error {
-	for _, tok := range bytes.Split(pay, []byte{OuterSep}) {
-		tok := bytes.SplitN(tok, []byte{InnerSep}, 2)
+	return pkt.UnmarshalFormat(pay, nil)
+}
+
+// UnmarshalFormat is like Unmarshal but reads the timestamp in format f.
+func (pkt *Packet) UnmarshalFormat(pay []byte, f *Format) error {
+	var res error
+	var raw []byte
+
+	pay = trimEnd(pay)
+
+	for len(pay) > 0 {
+		var tok []byte
+
+		tok, pay = cut(pay, OuterSep)
+		key, val := cut(tok, InnerSep)
 
-		if len(tok) != 2 {
+		if val == nil {
 			continue
 		}
 
-		k := string(bytes.Trim(tok[0], "\n\t\r "))
-		v := tok[1]
+		k := string(bytes.Trim(unescape(key), "\n\t\r "))
+		v := unescape(val)
 
 		switch k {
 		case "method", "meth", "m":
-			if err := pkt.Method.unmarshal(v); err != nil {
-				return fmt.Errorf("method: %w", err)
+			if err := pkt.Method.unmarshal(v); err != nil && res == nil {
+				res = fmt.Errorf("method: %w", err)
 			}
 		case "time", "t":
-			if err := pkt.Stamp.unmarshal(v); err != nil {
-				return fmt.Errorf("time: %w", err)
+			if err := pkt.Stamp.unmarshal(v, f); err != nil && res == nil {
+				res = fmt.Errorf("time: %w", err)
 			}
 		case "name", "n":
 			pkt.Topic = string(v)
 		case "value", "val", "v":
 			pkt.Value = string(v)
+			raw = val
+		case "descr", "description", "d":
+			pkt.Descr = string(v)
+		case "type":
+			pkt.Type = string(v)
+		case "kind":
+			if err := pkt.Kind.unmarshal(v); err != nil && res == nil {
+				res = fmt.Errorf("kind: %w", err)
+			}
+		case "len", "length":
+			n, err := strconv.Atoi(string(v))
+
+			if err != nil || n < 0 {
+				if res == nil {
+					res = fmt.Errorf("len: invalid: %s", v)
+				}
+
+				continue
+			}
+
+			pkt.Len = n
+		case "units", "u":
+			pkt.Units = string(v)
+		case "severity", "sev":
+			if err := pkt.Severity.UnmarshalText(v); err != nil && res == nil {
+				res = fmt.Errorf("severity: %w", err)
+			}
+		case "status", "stat":
+			pkt.Status = string(v)
+		case "user", "username":
+			pkt.User = string(v)
+		case "pass", "password":
+			pkt.Pass = string(v)
+		case "id":
+			pkt.ID = string(v)
 		}
 	}
 
+	// Array elements are unescaped one by one, so that an escaped ArraySep
+	// is told from a separating one.
+	if pkt.Kind == Array && raw != nil {
+		pkt.Value = string(raw)
+	}
+
 	if pkt.Value == "none" {
 		pkt.Value = ""
 	}
 
-	return nil
+	if pkt.Descr == "none" {
+		pkt.Descr = ""
+	}
+
+	if pkt.Units == "none" {
+		pkt.Units = ""
+	}
+
+	return res
+}
+
+func orDefault(s, def string) string {
+	if s == "" {
+		return def
+	}
+
+	return s
+}
+
+// Redact returns a copy of the lines in pay with the values of the pass and
+// password tokens masked, so that traffic can be logged.
+func Redact(pay []byte) []byte {
+	res := make([]byte, 0, len(pay))
+
+	for i, line := range bytes.Split(pay, []byte{'\n'}) {
+		if i > 0 {
+			res = append(res, '\n')
+		}
+
+		for {
+			tok, rest := cut(line, OuterSep)
+			key, val := cut(tok, InnerSep)
+
+			switch string(bytes.Trim(unescape(key), "\n\t\r ")) {
+			case "pass", "password":
+				if val != nil {
+					tok = append(key[:len(key):len(key)], InnerSep, '*', '*', '*')
+				}
+			}
+
+			res = append(res, tok...)
+
+			if rest == nil {
+				break
+			}
+
+			res = append(res, OuterSep)
+			line = rest
+		}
+	}
+
+	return res
+}
+
+// trimEnd strips the line terminator and any whitespace following it.
+// Spaces before the terminator belong to the last value and are kept.
+func trimEnd(b []byte) []byte {
+	i := bytes.LastIndexAny(b, "\r\n")
+
+	if i < 0 || len(bytes.TrimSpace(b[i+1:])) > 0 {
+		return b
+	}
+
+	return bytes.TrimRight(b[:i], "\r\n")
+}
+
+// cut splits b around the first unescaped sep. The second result is nil
+// when sep is absent.
+func cut(b []byte, sep byte) ([]byte, []byte) {
+	for i := 0; i < len(b); i++ {
+		switch b[i] {
+		case EscapeCh:
+			i++
+		case sep:
+			return b[:i], b[i+1:]
+		}
+	}
+
+	return b, nil
+}
+
+// escape writes s so that it survives framing and splitting. InnerSep is
+// left as is: only the first one in a token separates the key, and legacy
+// clients match names such as RING:BPM:01:X literally.
+func escape(buf *bytes.Buffer, s string) {
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; c {
+		case EscapeCh, OuterSep:
+			buf.WriteByte(EscapeCh)
+			buf.WriteByte(c)
+		case '\n':
+			buf.WriteString("\\n")
+		case '\r':
+			buf.WriteString("\\r")
+		case '\t':
+			buf.WriteString("\\t")
+		default:
+			buf.WriteByte(c)
+		}
+	}
+}
+
+// unescape reverses escape. Unknown escape sequences are kept verbatim so
+// that legacy traffic with bare backslashes parses as before.
+func unescape(b []byte) []byte {
+	if bytes.IndexByte(b, EscapeCh) < 0 {
+		return b
+	}
+
+	res := make([]byte, 0, len(b))
+
+	for i := 0; i < len(b); i++ {
+		if b[i] != EscapeCh || i+1 == len(b) {
+			res = append(res, b[i])
+			continue
+		}
+
+		switch c := b[i+1]; c {
+		case EscapeCh, OuterSep, InnerSep:
+			res = append(res, c)
+		case 'n':
+			res = append(res, '\n')
+		case 'r':
+			res = append(res, '\r')
+		case 't':
+			res = append(res, '\t')
+		default:
+			res = append(res, EscapeCh, c)
+		}
+
+		i++
+	}
+
+	return res
 }
@@ -3,13 +3,30 @@ package vcas
 import (
 	"fmt"
 	"math/rand/v2"
+	"os"
 	"strconv"
 	"testing"
 	"time"
+	_ "time/tzdata"
 
 	"github.com/stretchr/testify/assert"
 )
 
+// TestMain runs the tests in the zone the gateway is deployed in, which the
+// timestamps of the expected lines are written in.
+func TestMain(m *testing.M) {
+	loc, err := time.LoadLocation("Asia/Novosibirsk")
+
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "zone:", err)
+		os.Exit(1)
+	}
+
+	time.Local = loc
+
+	os.Exit(m.Run())
+}
+
 func TestMarshal(t *testing.T) {
 	cases := map[string]struct {
 		inp Packet
@@ -92,6 +109,88 @@ func TestMarshal(t *testing.T) {
 				res: "time:11.06.2005 23_59_59.999|method:set|name:test|val:none|descr:none|type:rw|units:none\n",
 			},
 		},
+		`with attributes`: {
+			inp: Packet{
+				Method: PUB,
+				Topic:  "test",
+				Stamp:  Time{time.UnixMilli(1118509199999)},
+				Value:  "11.06",
+				Descr:  "beam current",
+				Type:   "r",
+				Units:  "mA",
+			},
+			exp: struct {
+				err bool
+				res string
+			}{
+				err: false,
+				res: "time:11.06.2005 23_59_59.999|method:set|name:test|val:11.06|descr:beam current|type:r|units:mA\n",
+			},
+		},
+		`with escapes`: {
+			inp: Packet{
+				Method: PUB,
+				Topic:  "test|a:b",
+				Stamp:  Time{time.UnixMilli(1118509199999)},
+				Value:  "http://host/a|b\\c\nd",
+			},
+			exp: struct {
+				err bool
+				res string
+			}{
+				err: false,
+				res: "time:11.06.2005 23_59_59.999|method:set|name:test\\|a:b|val:http://host/a\\|b\\\\c\\nd|descr:none|type:rw|units:none\n",
+			},
+		},
+		`with id`: {
+			inp: Packet{
+				Method: ACK,
+				Topic:  "test",
+				Stamp:  Time{time.UnixMilli(1118509199999)},
+				Value:  "11.06",
+				ID:     "42",
+			},
+			exp: struct {
+				err bool
+				res string
+			}{
+				err: false,
+				res: "time:11.06.2005 23_59_59.999|method:ack|name:test|val:11.06|descr:none|type:rw|units:none|id:42\n",
+			},
+		},
+		`with array`: {
+			inp: Packet{
+				Method: PUB,
+				Topic:  "test",
+				Stamp:  Time{time.UnixMilli(1118509199999)},
+				Value:  "1.5,2,a\\,b",
+				Kind:   Array,
+			},
+			exp: struct {
+				err bool
+				res string
+			}{
+				err: false,
+				res: "time:11.06.2005 23_59_59.999|method:set|name:test|val:1.5,2,a\\,b|descr:none|type:rw|units:none|kind:array|len:3\n",
+			},
+		},
+		`with alarm`: {
+			inp: Packet{
+				Method:   PUB,
+				Topic:    "test",
+				Stamp:    Time{time.UnixMilli(1118509199999)},
+				Value:    "11.06",
+				Severity: Major,
+				Status:   "HIHI",
+			},
+			exp: struct {
+				err bool
+				res string
+			}{
+				err: false,
+				res: "time:11.06.2005 23_59_59.999|method:set|name:test|val:11.06|descr:none|type:rw|units:none|severity:MAJOR|status:HIHI\n",
+			},
+		},
 		`with unknown method`: {
 			inp: Packet{
 				Topic: "test",
@@ -166,6 +265,7 @@ func TestUnmarshal(t *testing.T) {
 			}{
 				err: false,
 				res: Packet{
+					Type:   "rw",
 					Method: PUB,
 					Topic:  "test",
 					Stamp:  Time{time.UnixMilli(1118509199999)},
@@ -181,6 +281,7 @@ func TestUnmarshal(t *testing.T) {
 			}{
 				err: false,
 				res: Packet{
+					Type:   "rw",
 					Method: PUB,
 					Topic:  "test",
 					Stamp:  Time{time.UnixMilli(1118509199999)},
@@ -196,6 +297,7 @@ func TestUnmarshal(t *testing.T) {
 			}{
 				err: false,
 				res: Packet{
+					Type:   "rw",
 					Method: SUB,
 					Topic:  "test",
 					Stamp:  Time{time.UnixMilli(1118509199999)},
@@ -211,6 +313,7 @@ func TestUnmarshal(t *testing.T) {
 			}{
 				err: false,
 				res: Packet{
+					Type:   "rw",
 					Method: SUB,
 					Topic:  "test",
 					Stamp:  Time{time.UnixMilli(1118509199999)},
@@ -226,6 +329,7 @@ func TestUnmarshal(t *testing.T) {
 			}{
 				err: false,
 				res: Packet{
+					Type:   "rw",
 					Method: SUB,
 					Topic:  "test",
 					Stamp:  Time{time.UnixMilli(1118509199999)},
@@ -241,6 +345,7 @@ func TestUnmarshal(t *testing.T) {
 			}{
 				err: false,
 				res: Packet{
+					Type:   "rw",
 					Method: USB,
 					Topic:  "test",
 					Stamp:  Time{time.UnixMilli(1118509199999)},
@@ -256,6 +361,7 @@ func TestUnmarshal(t *testing.T) {
 			}{
 				err: false,
 				res: Packet{
+					Type:   "rw",
 					Method: USB,
 					Topic:  "test",
 					Stamp:  Time{time.UnixMilli(1118509199999)},
@@ -263,6 +369,34 @@ func TestUnmarshal(t *testing.T) {
 				},
 			},
 		},
+		`psub(psubscribe)`: {
+			inp: "time:11.06.2005 23_59_59.999|method:psubscribe|name:RING:BPM:+:X",
+			exp: struct {
+				err bool
+				res Packet
+			}{
+				err: false,
+				res: Packet{
+					Method: PSUB,
+					Topic:  "RING:BPM:+:X",
+					Stamp:  Time{time.UnixMilli(1118509199999)},
+				},
+			},
+		},
+		`pusb(prel)`: {
+			inp: "time:11.06.2005 23_59_59.999|method:prel|name:RING:#",
+			exp: struct {
+				err bool
+				res Packet
+			}{
+				err: false,
+				res: Packet{
+					Method: PUSB,
+					Topic:  "RING:#",
+					Stamp:  Time{time.UnixMilli(1118509199999)},
+				},
+			},
+		},
 		`get(getfull)`: {
 			inp: "time:11.06.2005 23_59_59.999|method:getfull|name:test|val:11.06|descr:none|type:rw|units:none",
 			exp: struct {
@@ -271,6 +405,7 @@ func TestUnmarshal(t *testing.T) {
 			}{
 				err: false,
 				res: Packet{
+					Type:   "rw",
 					Method: GET,
 					Topic:  "test",
 					Stamp:  Time{time.UnixMilli(1118509199999)},
@@ -286,6 +421,7 @@ func TestUnmarshal(t *testing.T) {
 			}{
 				err: false,
 				res: Packet{
+					Type:   "rw",
 					Method: GET,
 					Topic:  "test",
 					Stamp:  Time{time.UnixMilli(1118509199999)},
@@ -301,6 +437,7 @@ func TestUnmarshal(t *testing.T) {
 			}{
 				err: false,
 				res: Packet{
+					Type:   "rw",
 					Method: GET,
 					Topic:  "test",
 					Stamp:  Time{time.UnixMilli(1118509199999)},
@@ -316,6 +453,7 @@ func TestUnmarshal(t *testing.T) {
 			}{
 				err: false,
 				res: Packet{
+					Type:   "rw",
 					Method: GET,
 					Topic:  "test",
 					Stamp:  Time{time.UnixMilli(1118509199999)},
@@ -323,6 +461,19 @@ func TestUnmarshal(t *testing.T) {
 				},
 			},
 		},
+		`ping(ping)`: {
+			inp: "time:11.06.2005 23_59_59.999|method:ping",
+			exp: struct {
+				err bool
+				res Packet
+			}{
+				err: false,
+				res: Packet{
+					Method: PING,
+					Stamp:  Time{time.UnixMilli(1118509199999)},
+				},
+			},
+		},
 		`time(t)`: {
 			inp: "t:11.06.2005 23_59_59.999|method:set|name:test|val:11.06|descr:none|type:rw|units:none",
 			exp: struct {
@@ -331,6 +482,7 @@ func TestUnmarshal(t *testing.T) {
 			}{
 				err: false,
 				res: Packet{
+					Type:   "rw",
 					Method: PUB,
 					Topic:  "test",
 					Stamp:  Time{time.UnixMilli(1118509199999)},
@@ -346,6 +498,7 @@ func TestUnmarshal(t *testing.T) {
 			}{
 				err: false,
 				res: Packet{
+					Type:   "rw",
 					Method: PUB,
 					Topic:  "test",
 					Stamp:  Time{time.UnixMilli(1118509199999)},
@@ -361,6 +514,7 @@ func TestUnmarshal(t *testing.T) {
 			}{
 				err: false,
 				res: Packet{
+					Type:   "rw",
 					Method: PUB,
 					Topic:  "test",
 					Stamp:  Time{time.UnixMilli(1118509199999)},
@@ -376,6 +530,7 @@ func TestUnmarshal(t *testing.T) {
 			}{
 				err: false,
 				res: Packet{
+					Type:   "rw",
 					Method: PUB,
 					Topic:  "test",
 					Stamp:  Time{time.UnixMilli(1118509199999)},
@@ -391,6 +546,7 @@ func TestUnmarshal(t *testing.T) {
 			}{
 				err: false,
 				res: Packet{
+					Type:   "rw",
 					Method: PUB,
 					Topic:  "test",
 					Stamp:  Time{time.UnixMilli(1118509199999)},
@@ -406,6 +562,7 @@ func TestUnmarshal(t *testing.T) {
 			}{
 				err: false,
 				res: Packet{
+					Type:   "rw",
 					Method: PUB,
 					Topic:  "test",
 					Stamp:  Time{time.UnixMilli(1118509199999)},
@@ -421,6 +578,7 @@ func TestUnmarshal(t *testing.T) {
 			}{
 				err: false,
 				res: Packet{
+					Type:   "rw",
 					Method: PUB,
 					Topic:  "test",
 					Stamp:  Time{time.UnixMilli(1118509199999)},
@@ -436,6 +594,7 @@ func TestUnmarshal(t *testing.T) {
 			}{
 				err: false,
 				res: Packet{
+					Type:   "rw",
 					Method: PUB,
 					Topic:  "test",
 					Stamp:  Time{time.UnixMilli(1118509199999)},
@@ -443,6 +602,23 @@ func TestUnmarshal(t *testing.T) {
 				},
 			},
 		},
+		`with trailing spaces`: {
+			inp: "time:11.06.2005 23_59_59.999|method:set|name:test|val:11.06|descr:none|type:rw|units:mA \r\n",
+			exp: struct {
+				err bool
+				res Packet
+			}{
+				err: false,
+				res: Packet{
+					Type:   "rw",
+					Method: PUB,
+					Topic:  "test",
+					Stamp:  Time{time.UnixMilli(1118509199999)},
+					Value:  "11.06",
+					Units:  "mA ",
+				},
+			},
+		},
 		`with inner escapes`: {
 			inp: "time:11.06.2005 23_59_59.999|\nmethod:set|name :test|val\t:11.06|descr:none|type:rw|units:none",
 			exp: struct {
@@ -451,6 +627,7 @@ func TestUnmarshal(t *testing.T) {
 			}{
 				err: false,
 				res: Packet{
+					Type:   "rw",
 					Method: PUB,
 					Topic:  "test",
 					Stamp:  Time{time.UnixMilli(1118509199999)},
@@ -466,6 +643,7 @@ func TestUnmarshal(t *testing.T) {
 			}{
 				err: false,
 				res: Packet{
+					Type:   "rw",
 					Method: PUB,
 					Topic:  "test",
 					Stamp:  Time{time.UnixMilli(1118509199999)},
@@ -481,6 +659,7 @@ func TestUnmarshal(t *testing.T) {
 			}{
 				err: false,
 				res: Packet{
+					Type:   "rw",
 					Method: PUB,
 					Topic:  "test",
 					Stamp:  Time{time.UnixMilli(1118509199999)},
@@ -495,6 +674,7 @@ func TestUnmarshal(t *testing.T) {
 			}{
 				err: false,
 				res: Packet{
+					Type:   "rw",
 					Method: PUB,
 					Topic:  "test",
 					Stamp:  Time{time.UnixMilli(1118509199999)},
@@ -503,6 +683,55 @@ func TestUnmarshal(t *testing.T) {
 		},
 		`without value`: {
 			inp: "time:11.06.2005 23_59_59.999|method:set|name:test|descr:none|type:rw|units:none",
+			exp: struct {
+				err bool
+				res Packet
+			}{
+				err: false,
+				res: Packet{
+					Type:   "rw",
+					Method: PUB,
+					Topic:  "test",
+					Stamp:  Time{time.UnixMilli(1118509199999)},
+				},
+			},
+		},
+		`with attributes`: {
+			inp: "time:11.06.2005 23_59_59.999|method:set|name:test|val:11.06|descr:beam current|type:r|units:mA",
+			exp: struct {
+				err bool
+				res Packet
+			}{
+				err: false,
+				res: Packet{
+					Method: PUB,
+					Topic:  "test",
+					Stamp:  Time{time.UnixMilli(1118509199999)},
+					Value:  "11.06",
+					Descr:  "beam current",
+					Type:   "r",
+					Units:  "mA",
+				},
+			},
+		},
+		`with escapes`: {
+			inp: "time:11.06.2005 23_59_59.999|method:set|name:test\\|a\\:b|val:http://host/a\\|b\\\\c\\nd|descr:none|type:rw|units:none",
+			exp: struct {
+				err bool
+				res Packet
+			}{
+				err: false,
+				res: Packet{
+					Method: PUB,
+					Topic:  "test|a:b",
+					Stamp:  Time{time.UnixMilli(1118509199999)},
+					Value:  "http://host/a|b\\c\nd",
+					Type:   "rw",
+				},
+			},
+		},
+		`with unescaped legacy value`: {
+			inp: "time:11.06.2005 23_59_59.999|method:set|name:test|val:C:\\data\\x:1|descr:none|type:rw|units:none",
 			exp: struct {
 				err bool
 				res Packet
@@ -512,9 +741,104 @@ func TestUnmarshal(t *testing.T) {
 					Method: PUB,
 					Topic:  "test",
 					Stamp:  Time{time.UnixMilli(1118509199999)},
+					Value:  "C:\\data\\x:1",
+					Type:   "rw",
+				},
+			},
+		},
+		`with id`: {
+			inp: "time:11.06.2005 23_59_59.999|method:set|name:test|val:11.06|id:42",
+			exp: struct {
+				err bool
+				res Packet
+			}{
+				err: false,
+				res: Packet{
+					Method: PUB,
+					Topic:  "test",
+					Stamp:  Time{time.UnixMilli(1118509199999)},
+					Value:  "11.06",
+					ID:     "42",
+				},
+			},
+		},
+		`with kind`: {
+			inp: "time:11.06.2005 23_59_59.999|method:set|name:test|val:11.06|kind:double",
+			exp: struct {
+				err bool
+				res Packet
+			}{
+				err: false,
+				res: Packet{
+					Method: PUB,
+					Topic:  "test",
+					Stamp:  Time{time.UnixMilli(1118509199999)},
+					Value:  "11.06",
+					Kind:   Float,
+				},
+			},
+		},
+		`with unknown kind`: {
+			inp: "time:11.06.2005 23_59_59.999|method:set|name:test|val:11.06|kind:complex",
+			exp: struct {
+				err bool
+				res Packet
+			}{
+				err: true,
+			},
+		},
+		`with array`: {
+			inp: "time:11.06.2005 23_59_59.999|method:set|name:test|val:1.5,2,3|kind:array|len:3",
+			exp: struct {
+				err bool
+				res Packet
+			}{
+				err: false,
+				res: Packet{
+					Method: PUB,
+					Topic:  "test",
+					Stamp:  Time{time.UnixMilli(1118509199999)},
+					Value:  "1.5,2,3",
+					Kind:   Array,
+					Len:    3,
+				},
+			},
+		},
+		`with malformed len`: {
+			inp: "time:11.06.2005 23_59_59.999|method:set|name:test|val:1.5,2,3|kind:array|len:-1",
+			exp: struct {
+				err bool
+				res Packet
+			}{
+				err: true,
+			},
+		},
+		`with alarm`: {
+			inp: "time:11.06.2005 23_59_59.999|method:set|name:test|val:11.06|sev:minor|stat:HIGH",
+			exp: struct {
+				err bool
+				res Packet
+			}{
+				err: false,
+				res: Packet{
+					Method:   PUB,
+					Topic:    "test",
+					Stamp:    Time{time.UnixMilli(1118509199999)},
+					Value:    "11.06",
+					Severity: Minor,
+					Status:   "HIGH",
 				},
 			},
 		},
+		`with unknown severity`: {
+			inp: "time:11.06.2005 23_59_59.999|method:set|name:test|val:11.06|severity:HIHI",
+			exp: struct {
+				err bool
+				res Packet
+			}{
+				err: true,
+			},
+		},
 		`with malformed time`: {
 			inp: "time:11.06.2005 23:59:59.999|method:set|name:test|val:11.06|descr:none|type:rw|units:none",
 			exp: struct {
@@ -532,6 +856,7 @@ func TestUnmarshal(t *testing.T) {
 			}{
 				err: false,
 				res: Packet{
+					Type:   "rw",
 					Method: PUB,
 					Topic:  "test",
 					Value:  "11.06",
@@ -546,6 +871,7 @@ func TestUnmarshal(t *testing.T) {
 			}{
 				err: false,
 				res: Packet{
+					Type:   "rw",
 					Method: PUB,
 					Stamp:  Time{time.UnixMilli(1118509199999)},
 					Value:  "11.06",
@@ -560,6 +886,7 @@ func TestUnmarshal(t *testing.T) {
 			}{
 				err: false,
 				res: Packet{
+					Type:  "rw",
 					Stamp: Time{time.UnixMilli(1118509199999)},
 					Topic: "test",
 					Value: "11.06",
@@ -592,6 +919,111 @@ func TestUnmarshal(t *testing.T) {
 	}
 }
 
+func TestRoundTrip(t *testing.T) {
+	// Separators, escapes and spaces are drawn often enough to end up at
+	// both ends of a field.
+	const set = "aZ0 .,:|\\\n\r\t\xff"
+
+	gen := func() string {
+		b := make([]byte, rand.IntN(32)+1)
+
+		for i := range b {
+			b[i] = set[rand.IntN(len(set))]
+		}
+
+		return string(b)
+	}
+
+	for i := 0; i < 1000; i++ {
+		inp := Packet{
+			Method: PUB,
+			Stamp:  Time{time.UnixMilli(1118509199999)},
+			Topic:  gen(),
+			Value:  gen(),
+			Descr:  gen(),
+			Type:   gen(),
+			Units:  gen(),
+			Status: gen(),
+			ID:     gen(),
+		}
+
+		pay, err := inp.Marshal(make([]byte, 0))
+		assert.Nil(t, err)
+
+		res := Packet{}
+		err = res.Unmarshal(pay)
+
+		assert.Nil(t, err)
+		assert.Equal(t, inp, res, "%q", pay)
+	}
+}
+
+func TestRedact(t *testing.T) {
+	tests := map[string]struct {
+		inp string
+		exp string
+	}{
+		`without pass`: {
+			inp: "method:set|name:test|val:1\n",
+			exp: "method:set|name:test|val:1\n",
+		},
+		`pass`: {
+			inp: "method:login|user:op|pass:secret\n",
+			exp: "method:login|user:op|pass:***\n",
+		},
+		`password with separators`: {
+			inp: "method:login|password:se\\|cr:et|user:op",
+			exp: "method:login|password:***|user:op",
+		},
+		`several lines`: {
+			inp: "method:login|pass:a\r\n pass:b|name:x\n",
+			exp: "method:login|pass:***\n pass:***|name:x\n",
+		},
+		`key only`: {
+			inp: "method:login|pass",
+			exp: "method:login|pass",
+		},
+	}
+
+	for n, test := range tests {
+		t.Run(n, func(t *testing.T) {
+			assert.Equal(t, test.exp, string(Redact([]byte(test.inp))))
+		})
+	}
+}
+
+func waveform(n int) string {
+	buf := make([]byte, 0, n*12)
+
+	for i := 0; i < n; i++ {
+		if i > 0 {
+			buf = append(buf, ArraySep)
+		}
+
+		buf = strconv.AppendFloat(buf, rand.Float64()*100, 'f', 7, 64)
+	}
+
+	return string(buf)
+}
+
+func BenchmarkMarshalArray(b *testing.B) {
+	pkt := Packet{
+		Method: PUB,
+		Topic:  "VEPP/CCD/1M1L/profile",
+		Stamp:  Time{time.UnixMilli(1118509199999)},
+		Value:  waveform(4096),
+		Kind:   Array,
+	}
+
+	pay := make([]byte, 0, len(pkt.Value)+0xff)
+
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		pkt.Marshal(pay)
+	}
+}
+
 func BenchmarkUnmarshal(b *testing.B) {
 	for i := 0; i < b.N; i++ {
 		b.StopTimer()
@@ -606,3 +1038,17 @@ func BenchmarkUnmarshal(b *testing.B) {
     pkt.Unmarshal(pay)
 	}
 }
+
+func BenchmarkUnmarshalArray(b *testing.B) {
+	pay := []byte(fmt.Sprintf(
+		"time:11.06.2005 23_59_59.999|method:set|name:VEPP/CCD/1M1L/profile|val:%s|kind:array|len:4096",
+		waveform(4096),
+	))
+
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		pkt := Packet{}
+		pkt.Unmarshal(pay)
+	}
+}